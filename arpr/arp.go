@@ -12,7 +12,7 @@ func SendGratuitousArp(localIP net.IP, localMAC net.HardwareAddr) ([]byte, error
 	ethernet := &layers.Ethernet{
 		SrcMAC:       localMAC,
 		DstMAC:       layers.EthernetBroadcast,
-		EthernetType: layers.EthernetTypeIPv4,
+		EthernetType: layers.EthernetTypeARP,
 	}
 	arp := &layers.ARP{
 		AddrType:          layers.LinkTypeEthernet,
@@ -39,7 +39,44 @@ func SendGratuitousArp(localIP net.IP, localMAC net.HardwareAddr) ([]byte, error
 	return sbuf.Bytes(), nil
 }
 
+// SendRequest builds a broadcast ARP request asking who has targetIP
+func SendRequest(targetIP net.IP, localIP net.IP, localMAC net.HardwareAddr) ([]byte, error) {
+	ethernet := &layers.Ethernet{
+		SrcMAC:       localMAC,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   localMAC,
+		SourceProtAddress: localIP.To4(),
+		DstHwAddress:      net.HardwareAddr{0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		DstProtAddress:    targetIP.To4(),
+	}
+
+	sbuf := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+
+	if err := gopacket.SerializeLayers(sbuf, options, ethernet, arp); err != nil {
+		return nil, err
+	}
+
+	return sbuf.Bytes(), nil
+}
+
 func SendReply(arp *layers.ARP, localIP net.IP, localMAC net.HardwareAddr) ([]byte, error) {
+	return SendProxyReply(arp, localIP, localMAC, localMAC)
+}
+
+// SendProxyReply answers arp on behalf of another host: ip is at mac, sent from localMAC
+func SendProxyReply(arp *layers.ARP, ip net.IP, mac net.HardwareAddr, localMAC net.HardwareAddr) ([]byte, error) {
 	if arp.Operation != layers.ARPRequest {
 		return nil, fmt.Errorf("not an ARP request")
 	}
@@ -55,8 +92,8 @@ func SendReply(arp *layers.ARP, localIP net.IP, localMAC net.HardwareAddr) ([]by
 		HwAddressSize:     arp.HwAddressSize,
 		ProtAddressSize:   arp.ProtAddressSize,
 		Operation:         layers.ARPReply,
-		SourceHwAddress:   localMAC,
-		SourceProtAddress: localIP,
+		SourceHwAddress:   mac,
+		SourceProtAddress: ip.To4(),
 		DstHwAddress:      arp.SourceHwAddress,
 		DstProtAddress:    arp.SourceProtAddress,
 	}
@@ -6,13 +6,13 @@ require (
 	fyne.io/systray v1.11.0
 	github.com/gopacket/gopacket v1.3.1
 	github.com/pkg/browser v0.0.0-20240102092130-5ac0b6a4141c
+	golang.org/x/net v0.34.0
+	golang.org/x/sys v0.29.0
 	gvisor.dev/gvisor v0.0.0-20250111035124-3e96b7543593
 )
 
 require (
 	github.com/godbus/dbus/v5 v5.1.0 // indirect
 	github.com/google/btree v1.1.2 // indirect
-	golang.org/x/net v0.34.0 // indirect
-	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/time v0.9.0 // indirect
 )
@@ -0,0 +1,321 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+
+	// aclMaxPending bounds the clients waiting for approval
+	aclMaxPending = 256
+	// aclPendingTTL is how long a client waits for approval before it is forgotten,
+	// one that is still around queues again
+	aclPendingTTL = 30 * time.Minute
+)
+
+// ACLConfig decides which LAN clients may send traffic into the TUN or reach the gateway's
+// ping and DNS. ARP, neighbor discovery and DHCP are answered for every client, so a held
+// back one gets an address and is listed for approval with it.
+type ACLConfig struct {
+	// Default is "allow" (default) or "deny" for clients no rule matches
+	Default string    `json:"default"`
+	Rules   []ACLRule `json:"rules"`
+	// BlockUnknown drops clients no rule matches and lists them for approval
+	BlockUnknown bool `json:"block_unknown"`
+	// File keeps rules edited through the API across restarts, it overrides the ones above
+	File string `json:"file,omitempty"`
+}
+
+// ACLRule matches a client by MAC, IP or CIDR, a rule with both needs both to match
+type ACLRule struct {
+	Action  string `json:"action"`
+	MAC     string `json:"mac,omitempty"`
+	IP      string `json:"ip,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// ACLState is the access control config and the clients waiting for approval
+type ACLState struct {
+	ACLConfig
+	Pending []PendingClient `json:"pending"`
+}
+
+// PendingClient is an unknown device held back by BlockUnknown
+type PendingClient struct {
+	MAC       string    `json:"mac"`
+	IP        string    `json:"ip"`
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+type aclRule struct {
+	allow   bool
+	mac     net.HardwareAddr
+	network *net.IPNet
+}
+
+type accessList struct {
+	mu      sync.RWMutex
+	cfg     ACLConfig
+	rules   []aclRule
+	deny    bool
+	pending map[[6]byte]*PendingClient
+}
+
+func newAccessList(cfg ACLConfig) (*accessList, error) {
+	a := &accessList{pending: make(map[[6]byte]*PendingClient)}
+
+	if cfg.File != "" {
+		saved, err := loadACL(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		if saved != nil {
+			saved.File = cfg.File
+			cfg = *saved
+		}
+	}
+
+	if err := a.set(cfg); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// set compiles and installs cfg, called with mu held or before the list is shared
+func (a *accessList) set(cfg ACLConfig) error {
+	var deny bool
+	switch cfg.Default {
+	case "", ACLAllow:
+	case ACLDeny:
+		deny = true
+	default:
+		return fmt.Errorf("invalid default policy %q", cfg.Default)
+	}
+
+	rules := make([]aclRule, 0, len(cfg.Rules))
+	for i, r := range cfg.Rules {
+		rule, err := compileACLRule(r)
+		if err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	a.cfg, a.rules, a.deny = cfg, rules, deny
+	return nil
+}
+
+func compileACLRule(r ACLRule) (aclRule, error) {
+	var rule aclRule
+	switch r.Action {
+	case ACLAllow:
+		rule.allow = true
+	case ACLDeny:
+	default:
+		return rule, fmt.Errorf("invalid action %q", r.Action)
+	}
+
+	if r.MAC == "" && r.IP == "" {
+		return rule, fmt.Errorf("rule needs a mac or an ip")
+	}
+
+	if r.MAC != "" {
+		mac, err := net.ParseMAC(r.MAC)
+		if err != nil {
+			return rule, err
+		}
+		rule.mac = mac
+	}
+
+	if r.IP != "" {
+		if !strings.Contains(r.IP, "/") {
+			ip := net.ParseIP(r.IP)
+			if ip == nil {
+				return rule, fmt.Errorf("invalid ip %s", r.IP)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else {
+			_, network, err := net.ParseCIDR(r.IP)
+			if err != nil {
+				return rule, err
+			}
+			rule.network = network
+		}
+	}
+
+	return rule, nil
+}
+
+// allowed reports whether the client may send traffic into the TUN.
+// With BlockUnknown, a client no rule matches is queued for approval.
+func (a *accessList) allowed(mac net.HardwareAddr, ip net.IP) bool {
+	a.mu.RLock()
+	for _, r := range a.rules {
+		if r.mac != nil && !bytes.Equal(r.mac, mac) {
+			continue
+		}
+		if r.network != nil && !r.network.Contains(ip) {
+			continue
+		}
+		a.mu.RUnlock()
+		return r.allow
+	}
+	if !a.cfg.BlockUnknown {
+		deny := a.deny
+		a.mu.RUnlock()
+		return !deny
+	}
+	_, queued := a.pending[macKey(mac)]
+	a.mu.RUnlock()
+
+	if !queued {
+		a.queue(mac, ip)
+	}
+	return false
+}
+
+func (a *accessList) queue(mac net.HardwareAddr, ip net.IP) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := macKey(mac)
+	if _, ok := a.pending[key]; ok {
+		return
+	}
+	if len(a.pending) >= aclMaxPending {
+		a.evictPendingLocked()
+	}
+
+	a.pending[key] = &PendingClient{MAC: mac.String(), IP: ip.String(), FirstSeen: time.Now()}
+	slog.Info("unknown client waiting for approval", "mac", mac, "ip", ip)
+}
+
+// evictPendingLocked forgets the clients waiting longer than aclPendingTTL, or the one
+// waiting longest when none is, so made up MACs can't keep new clients out of the queue
+func (a *accessList) evictPendingLocked() {
+	now := time.Now()
+	var oldest [6]byte
+	var oldestSeen time.Time
+	for key, p := range a.pending {
+		if now.Sub(p.FirstSeen) > aclPendingTTL {
+			delete(a.pending, key)
+			continue
+		}
+		if oldestSeen.IsZero() || p.FirstSeen.Before(oldestSeen) {
+			oldest, oldestSeen = key, p.FirstSeen
+		}
+	}
+	if len(a.pending) >= aclMaxPending {
+		delete(a.pending, oldest)
+	}
+}
+
+// macKey is the map key of an ethernet address
+func macKey(mac net.HardwareAddr) (key [6]byte) {
+	copy(key[:], mac)
+	return key
+}
+
+// State returns the rules and the clients waiting for approval
+func (a *accessList) State() ACLState {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	st := ACLState{ACLConfig: a.cfg, Pending: make([]PendingClient, 0, len(a.pending))}
+	st.Rules = slices.Clone(a.cfg.Rules)
+	for _, p := range a.pending {
+		st.Pending = append(st.Pending, *p)
+	}
+	slices.SortFunc(st.Pending, func(x, y PendingClient) int {
+		return x.FirstSeen.Compare(y.FirstSeen)
+	})
+	return st
+}
+
+// Update replaces the rules, the file they are kept in stays the same
+func (a *accessList) Update(cfg ACLConfig) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cfg.File = a.cfg.File
+	if err := a.set(cfg); err != nil {
+		return err
+	}
+	a.save()
+	return nil
+}
+
+// Decide allows or denies a pending client by adding a rule for its MAC in front of the others
+func (a *accessList) Decide(mac net.HardwareAddr, action string) error {
+	rule := ACLRule{Action: action, MAC: mac.String(), Comment: "approved " + time.Now().Format(time.DateTime)}
+	if action == ACLDeny {
+		rule.Comment = "rejected " + time.Now().Format(time.DateTime)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if p, ok := a.pending[macKey(mac)]; ok {
+		rule.Comment += " as " + p.IP
+	}
+
+	cfg := a.cfg
+	cfg.Rules = append([]ACLRule{rule}, cfg.Rules...)
+	if err := a.set(cfg); err != nil {
+		return err
+	}
+	delete(a.pending, macKey(mac))
+	a.save()
+	return nil
+}
+
+func loadACL(file string) (*ACLConfig, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read acl error: %w", err)
+	}
+
+	var cfg ACLConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse acl error: %w", err)
+	}
+	return &cfg, nil
+}
+
+// save writes the rules to the ACL file, called with mu held
+func (a *accessList) save() {
+	if a.cfg.File == "" {
+		return
+	}
+
+	cfg := a.cfg
+	cfg.File = ""
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		slog.Error("marshal acl error", "err", err)
+		return
+	}
+
+	if err := os.WriteFile(a.cfg.File, data, 0644); err != nil {
+		slog.Error("write acl error", "err", err)
+	}
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestACLBlockUnknownNoAlloc(t *testing.T) {
+	a, err := newAccessList(ACLConfig{BlockUnknown: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.allowed(testClientMAC, testClientIP) {
+		t.Fatal("unknown client allowed")
+	}
+	// Frames of a client already waiting are on the forwarding hot path
+	if n := testing.AllocsPerRun(100, func() { a.allowed(testClientMAC, testClientIP) }); n != 0 {
+		t.Fatalf("%v allocations per frame of a pending client", n)
+	}
+	if st := a.State(); len(st.Pending) != 1 || st.Pending[0].MAC != testClientMAC.String() {
+		t.Fatalf("pending %+v", st.Pending)
+	}
+}
+
+func TestACLPendingEviction(t *testing.T) {
+	a, err := newAccessList(ACLConfig{BlockUnknown: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac := func(i int) net.HardwareAddr {
+		return net.HardwareAddr{0x06, 0, 0, 0, byte(i >> 8), byte(i)}
+	}
+	for i := range aclMaxPending {
+		a.allowed(mac(i), testClientIP)
+		a.pending[macKey(mac(i))].FirstSeen = time.Now().Add(-time.Duration(aclMaxPending-i) * time.Second)
+	}
+
+	// A full queue makes room by dropping the client waiting longest
+	a.allowed(testClientMAC, testClientIP)
+	if _, ok := a.pending[macKey(testClientMAC)]; !ok {
+		t.Fatal("new client not queued")
+	}
+	if _, ok := a.pending[macKey(mac(0))]; ok {
+		t.Fatal("longest waiting client kept")
+	}
+
+	// Expired clients all go at once
+	for key := range a.pending {
+		a.pending[key].FirstSeen = time.Now().Add(-2 * aclPendingTTL)
+	}
+	a.pending[macKey(testClientMAC)].FirstSeen = time.Now()
+	a.evictPendingLocked()
+	if len(a.pending) != 1 {
+		t.Fatalf("%d clients left after expiry, want 1", len(a.pending))
+	}
+}
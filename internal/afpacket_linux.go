@@ -0,0 +1,483 @@
+//go:build linux
+
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	afpacketBlockSize  = 1 << 18
+	afpacketBlockCount = 16
+	afpacketFrameSize  = 1 << 11
+	// afpacketBlockTimeout is how long in ms the kernel holds a partially filled block
+	afpacketBlockTimeout = 2
+	// afpacketBlockHeader is the offset of tpacket_hdr_v1 inside tpacket_block_desc
+	afpacketBlockHeader = 8
+	// afpacketProtocol loads skb->protocol in a socket filter, SKF_AD_OFF + SKF_AD_PROTOCOL
+	// of linux/filter.h, which x/sys/unix doesn't define
+	afpacketProtocol = 0xfffff000
+)
+
+var errAFPacketClosed = errors.New("af_packet socket closed")
+
+// afpacketFanouts numbers the fanout groups of this process, the ids are shared by the whole system
+var afpacketFanouts atomic.Uint32
+
+// AFPacket reads frames from a TPACKET_V3 memory-mapped ring and writes them with send(2).
+// It is pure Go, so binaries using it build without cgo and libpcap.
+// On the sing-box tun it sees the packets sing-box writes, its own writes are transmitted
+// on the device and so read by sing-box, the same data path as pcap.
+type AFPacket struct {
+	name      string
+	Interface net.Interface
+	fd        int
+	ring      []byte
+	// filter is the attached socket filter, copied to the queues
+	filter []unix.SockFilter
+
+	// fanout is the PACKET_FANOUT group id once queues were opened, guarded by fanoutMux
+	fanout    int
+	fanoutMux sync.Mutex
+
+	// read state, guarded by readMux
+	block   int
+	held    bool
+	pending uint32
+	offset  uint32
+	// tagBufs hold retagged frames, one per slot of a read batch
+	tagBufs [][]byte
+
+	// batchMux guards the sendmmsg scratch space
+	batchMux sync.Mutex
+	iovecs   []unix.Iovec
+	msgs     []mmsghdr
+
+	readMux  sync.Mutex
+	writeMux sync.RWMutex
+	closed   atomic.Bool
+}
+
+func openAFPacket(cfg InterfaceConfig) (PacketIO, error) {
+	t, err := NewAFPacket(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func NewAFPacket(cfg InterfaceConfig) (*AFPacket, error) {
+	iface, err := net.InterfaceByName(cfg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("find interface error: %w", err)
+	}
+	slog.Info("Using interface",
+		"name", iface.Name,
+		"backend", BackendAFPacket,
+		"mac", iface.HardwareAddr.String())
+
+	return newAFPacketSocket(cfg.Name, *iface)
+}
+
+func newAFPacketSocket(name string, iface net.Interface) (*AFPacket, error) {
+	// Protocol 0 receives nothing until the socket is bound with its filter in place
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("create af_packet socket error: %w", err)
+	}
+
+	t := &AFPacket{
+		name:      name,
+		Interface: iface,
+		fd:        fd,
+		fanout:    -1,
+	}
+
+	if err := t.setup(); err != nil {
+		if t.ring != nil {
+			unix.Munmap(t.ring)
+		}
+		unix.Close(fd)
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *AFPacket) setup() error {
+	err := unix.SetsockoptInt(t.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3)
+	if err != nil {
+		return fmt.Errorf("set tpacket v3 error: %w", err)
+	}
+
+	if err := t.attachFilter(afpacketFilter(nil)); err != nil {
+		return err
+	}
+
+	req := unix.TpacketReq3{
+		Block_size:     afpacketBlockSize,
+		Block_nr:       afpacketBlockCount,
+		Frame_size:     afpacketFrameSize,
+		Frame_nr:       afpacketBlockSize / afpacketFrameSize * afpacketBlockCount,
+		Retire_blk_tov: afpacketBlockTimeout,
+	}
+	if err := unix.SetsockoptTpacketReq3(t.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &req); err != nil {
+		return fmt.Errorf("set rx ring error: %w", err)
+	}
+
+	t.ring, err = unix.Mmap(t.fd, 0, afpacketBlockSize*afpacketBlockCount, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mmap rx ring error: %w", err)
+	}
+
+	err = unix.Bind(t.fd, &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ALL),
+		Ifindex:  t.Interface.Index,
+	})
+	if err != nil {
+		return fmt.Errorf("bind af_packet socket error: %w", err)
+	}
+
+	err = unix.SetsockoptPacketMreq(t.fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &unix.PacketMreq{
+		Ifindex: int32(t.Interface.Index),
+		Type:    unix.PACKET_MR_PROMISC,
+	})
+	if err != nil {
+		return fmt.Errorf("set promisc error: %w", err)
+	}
+
+	// A write to a link that doesn't drain fails with EAGAIN instead of holding up Close
+	tv := unix.NsecToTimeval(writeTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(t.fd, unix.SOL_SOCKET, unix.SO_SNDTIMEO, &tv); err != nil {
+		return fmt.Errorf("set send timeout error: %w", err)
+	}
+
+	// Our own writes would otherwise loop back into the ring, not supported before Linux 4.20
+	if err := unix.SetsockoptInt(t.fd, unix.SOL_PACKET, unix.PACKET_IGNORE_OUTGOING, 1); err != nil {
+		slog.Warn("af_packet can't ignore outgoing frames", "name", t.name, "err", err)
+	}
+
+	return nil
+}
+
+func (t *AFPacket) attachFilter(filter []unix.SockFilter) error {
+	err := unix.SetsockoptSockFprog(t.fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	})
+	if err != nil {
+		return fmt.Errorf("attach filter error: %w", err)
+	}
+	t.filter = filter
+	return nil
+}
+
+// OpenQueue opens another socket on the interface with the same filter. Both join a
+// PACKET_FANOUT group, which hands each flow to one of its sockets.
+func (t *AFPacket) OpenQueue() (PacketIO, error) {
+	t.fanoutMux.Lock()
+	defer t.fanoutMux.Unlock()
+
+	if t.fanout < 0 {
+		id := (os.Getpid() + int(afpacketFanouts.Add(1))) & 0xffff
+		if err := t.joinFanout(id); err != nil {
+			return nil, err
+		}
+		t.fanout = id
+	}
+
+	q, err := newAFPacketSocket(t.name, t.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.attachFilter(t.filter); err != nil {
+		q.Close()
+		return nil, err
+	}
+	if err := q.joinFanout(t.fanout); err != nil {
+		q.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+func (t *AFPacket) joinFanout(id int) error {
+	err := unix.SetsockoptInt(t.fd, unix.SOL_PACKET, unix.PACKET_FANOUT, id|unix.PACKET_FANOUT_HASH<<16)
+	if err != nil {
+		return fmt.Errorf("join fanout group error: %w", err)
+	}
+	return nil
+}
+
+// SetMACFilter narrows the capture to frames for mac and to broadcast and multicast
+func (t *AFPacket) SetMACFilter(mac net.HardwareAddr) error {
+	return t.attachFilter(afpacketFilter(mac))
+}
+
+// afpacketFilter accepts ARP, IPv4, IPv6 and 802.1Q frames, the pcap backend narrows further by network.
+// The protocol comes from the skb rather than offset 12, so it works on links without an
+// Ethernet header like a tun. With mac set, unicast frames must also be addressed to it.
+func afpacketFilter(mac net.HardwareAddr) []unix.SockFilter {
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, K: afpacketProtocol},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 4, K: unix.ETH_P_ARP},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 3, K: unix.ETH_P_IP},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 2, K: unix.ETH_P_IPV6},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: unix.ETH_P_8021Q},
+		{Code: unix.BPF_RET | unix.BPF_K, K: 0},
+		{Code: unix.BPF_RET | unix.BPF_K, K: 0xffff},
+	}
+	if len(mac) != 6 {
+		return filter
+	}
+
+	// Jumps are relative to the next instruction, the drop is filter[5]
+	dst := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: 0},
+		// The group bit passes broadcast and multicast
+		{Code: unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K, Jt: 4, K: 0x01},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 2},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 7, K: binary.BigEndian.Uint32(mac[2:6])},
+		{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, K: 0},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 5, K: uint32(binary.BigEndian.Uint16(mac[0:2]))},
+	}
+	return append(dst, filter...)
+}
+
+// Read returns a frame from the ring, which stays locked to the caller until Release
+// so the next read can't hand its block back to the kernel
+func (t *AFPacket) Read() []byte {
+	t.readMux.Lock()
+	frame := t.next(0)
+	if frame == nil {
+		t.readMux.Unlock()
+	}
+	return frame
+}
+
+// ReadBatch returns the frames the ring already holds, the first one is waited for like Read
+func (t *AFPacket) ReadBatch(frames [][]byte) int {
+	t.readMux.Lock()
+	frame := t.next(0)
+	if frame == nil {
+		t.readMux.Unlock()
+		return 0
+	}
+	frames[0] = frame
+
+	// Only from the held block, the next one can't be handed back while these are borrowed
+	n := 1
+	for n < len(frames) && t.pending > 0 {
+		frames[n] = t.take(n)
+		n++
+	}
+	return n
+}
+
+func (t *AFPacket) Release() {
+	t.readMux.Unlock()
+}
+
+// next returns the next frame of the ring for batch slot, called with readMux held
+func (t *AFPacket) next(slot int) []byte {
+	for !t.closed.Load() {
+		if t.pending > 0 {
+			return t.take(slot)
+		}
+
+		// Every frame of the held block was returned, hand it back to the kernel
+		if t.held {
+			atomic.StoreUint32(&t.blockHeader().Block_status, unix.TP_STATUS_KERNEL)
+			t.block = (t.block + 1) % afpacketBlockCount
+			t.held = false
+		}
+
+		hdr := t.blockHeader()
+		if atomic.LoadUint32(&hdr.Block_status)&unix.TP_STATUS_USER == 0 {
+			if !t.wait() {
+				return nil
+			}
+			continue
+		}
+
+		t.held = true
+		t.pending = hdr.Num_pkts
+		t.offset = hdr.Offset_to_first_pkt
+	}
+
+	return nil
+}
+
+// take returns the next frame of the held block, there must be one pending
+func (t *AFPacket) take(slot int) []byte {
+	block := t.ring[t.block*afpacketBlockSize : (t.block+1)*afpacketBlockSize]
+	hdr := (*unix.Tpacket3Hdr)(unsafe.Pointer(&block[t.offset]))
+	start := t.offset + uint32(hdr.Mac)
+	t.offset += hdr.Next_offset
+	t.pending--
+	frame := block[start : start+hdr.Snaplen]
+	if hdr.Status&unix.TP_STATUS_VLAN_VALID != 0 {
+		return t.retag(slot, frame, hdr)
+	}
+	return frame
+}
+
+// retag puts back the 802.1Q tag the NIC stripped into the ring metadata,
+// so VLANs look the same to the bridge as with the pcap backend
+func (t *AFPacket) retag(slot int, frame []byte, hdr *unix.Tpacket3Hdr) []byte {
+	if len(frame) < header.EthernetMinimumSize {
+		return frame
+	}
+
+	tpid := uint16(etherTypeVLAN)
+	if hdr.Status&unix.TP_STATUS_VLAN_TPID_VALID != 0 {
+		tpid = hdr.Hv1.Vlan_tpid
+	}
+
+	for len(t.tagBufs) <= slot {
+		t.tagBufs = append(t.tagBufs, nil)
+	}
+	buf := append(t.tagBufs[slot][:0], frame[:12]...)
+	buf = binary.BigEndian.AppendUint16(buf, tpid)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(hdr.Hv1.Vlan_tci))
+	buf = append(buf, frame[12:]...)
+	t.tagBufs[slot] = buf
+	return buf
+}
+
+func (t *AFPacket) blockHeader() *unix.TpacketHdrV1 {
+	return (*unix.TpacketHdrV1)(unsafe.Pointer(&t.ring[t.block*afpacketBlockSize+afpacketBlockHeader]))
+}
+
+// wait blocks until the ring has data or readTimeout expires
+func (t *AFPacket) wait() bool {
+	fds := []unix.PollFd{{Fd: int32(t.fd), Events: unix.POLLIN | unix.POLLERR}}
+	n, err := unix.Poll(fds, int(readTimeout.Milliseconds()))
+	if err != nil {
+		if err != unix.EINTR {
+			slog.Error("poll af_packet error", "name", t.name, "err", err)
+		}
+		return false
+	}
+	return n > 0
+}
+
+func (t *AFPacket) Write(p []byte) error {
+	t.writeMux.RLock()
+	defer t.writeMux.RUnlock()
+
+	if t.closed.Load() {
+		return errAFPacketClosed
+	}
+
+	for {
+		_, err := unix.Write(t.fd, p)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("write packet error: %w", err)
+		}
+		return nil
+	}
+}
+
+// mmsghdr is struct mmsghdr of sendmmsg(2), which x/sys/unix doesn't define
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// WriteBatch sends the frames with sendmmsg(2), as few system calls as the kernel allows
+func (t *AFPacket) WriteBatch(frames [][]byte) error {
+	t.writeMux.RLock()
+	defer t.writeMux.RUnlock()
+
+	if t.closed.Load() {
+		return errAFPacketClosed
+	}
+
+	t.batchMux.Lock()
+	defer t.batchMux.Unlock()
+
+	t.iovecs = t.iovecs[:0]
+	for _, frame := range frames {
+		if len(frame) == 0 {
+			continue
+		}
+		iov := unix.Iovec{Base: &frame[0]}
+		iov.SetLen(len(frame))
+		t.iovecs = append(t.iovecs, iov)
+	}
+
+	// The headers point into iovecs, which doesn't grow any more
+	t.msgs = t.msgs[:0]
+	for i := range t.iovecs {
+		var msg mmsghdr
+		msg.hdr.Iov = &t.iovecs[i]
+		msg.hdr.SetIovlen(1)
+		t.msgs = append(t.msgs, msg)
+	}
+
+	for sent := 0; sent < len(t.msgs); {
+		n, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(t.fd),
+			uintptr(unsafe.Pointer(&t.msgs[sent])), uintptr(len(t.msgs)-sent), 0, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return fmt.Errorf("write batch error: %w", errno)
+		}
+		sent += int(n)
+	}
+	return nil
+}
+
+func (t *AFPacket) LinkType() layers.LinkType {
+	if len(t.Interface.HardwareAddr) == 6 {
+		return layers.LinkTypeEthernet
+	}
+	// Interfaces without a link header, like tun devices, carry bare IP packets
+	return layers.LinkTypeRaw
+}
+
+func (t *AFPacket) MTU() int {
+	return t.Interface.MTU
+}
+
+func (t *AFPacket) MAC() net.HardwareAddr {
+	return t.Interface.HardwareAddr
+}
+
+func (t *AFPacket) Close() {
+	if t.closed.Swap(true) {
+		return
+	}
+
+	// Readers leave within readTimeout, writers within writeTimeout, later ones see the closed flag
+	t.writeMux.Lock()
+	defer t.writeMux.Unlock()
+	t.readMux.Lock()
+	defer t.readMux.Unlock()
+
+	unix.Munmap(t.ring)
+	unix.Close(t.fd)
+}
+
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// afpacketVM runs the filter in the bpf VM. The VM has no skb, so the protocol load is
+// checked and replaced by a load of the ethertype, which is the same for untagged frames.
+func afpacketVM(t *testing.T, mac net.HardwareAddr) *bpf.VM {
+	t.Helper()
+
+	var prog []bpf.Instruction
+	var protocol bool
+	for _, f := range afpacketFilter(mac) {
+		ins := bpf.RawInstruction{Op: f.Code, Jt: f.Jt, Jf: f.Jf, K: f.K}.Disassemble()
+		if ins == (bpf.LoadExtension{Num: bpf.ExtProto}) {
+			ins, protocol = bpf.LoadAbsolute{Off: 12, Size: 2}, true
+		}
+		prog = append(prog, ins)
+	}
+	if !protocol {
+		t.Fatal("filter doesn't load skb->protocol")
+	}
+
+	vm, err := bpf.NewVM(prog)
+	if err != nil {
+		t.Fatalf("filter rejected by the vm: %v", err)
+	}
+	return vm
+}
+
+func TestAFPacketFilter(t *testing.T) {
+	other := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x09}
+	nearly := net.HardwareAddr{0x12, 0, 0, 0, 0, 0x01}
+	multicast := net.HardwareAddr{0x01, 0, 0x5e, 0, 0, 0x01}
+
+	for _, tc := range []struct {
+		name      string
+		dst       net.HardwareAddr
+		etherType layers.EthernetType
+		accept    bool
+		// any is the verdict without a MAC filter
+		any bool
+	}{
+		{"arp", testNICMAC, layers.EthernetTypeARP, true, true},
+		{"ipv4", testNICMAC, layers.EthernetTypeIPv4, true, true},
+		{"ipv6", testNICMAC, layers.EthernetTypeIPv6, true, true},
+		{"vlan", testNICMAC, layers.EthernetTypeDot1Q, true, true},
+		{"lldp", testNICMAC, layers.EthernetTypeLinkLayerDiscovery, false, false},
+		{"pppoe", testNICMAC, layers.EthernetTypePPPoEDiscovery, false, false},
+		{"broadcast", layers.EthernetBroadcast, layers.EthernetTypeARP, true, true},
+		{"multicast", multicast, layers.EthernetTypeIPv6, true, true},
+		{"other host", other, layers.EthernetTypeIPv4, false, true},
+		{"other oui", nearly, layers.EthernetTypeIPv4, false, true},
+		{"broadcast lldp", layers.EthernetBroadcast, layers.EthernetTypeLinkLayerDiscovery, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			frame := serialize(t, &layers.Ethernet{SrcMAC: testClientMAC, DstMAC: tc.dst, EthernetType: tc.etherType}, gopacket.Payload(make([]byte, 46)))
+
+			for _, mac := range []net.HardwareAddr{nil, testNICMAC} {
+				n, err := afpacketVM(t, mac).Run(frame)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := tc.any
+				if mac != nil {
+					want = tc.accept
+				}
+				if got := n > 0; got != want {
+					t.Fatalf("mac filter %s: accepted %v, want %v", mac, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAFPacketFilterProtocolLoad(t *testing.T) {
+	// Offset 12 would read the first address bytes of a bare IP packet on a tun
+	for _, mac := range []net.HardwareAddr{nil, testNICMAC} {
+		filter := afpacketFilter(mac)
+		for _, f := range filter {
+			if f.Code == unix.BPF_LD|unix.BPF_H|unix.BPF_ABS && f.K == 12 {
+				t.Fatal("filter loads the protocol from offset 12")
+			}
+		}
+		if last := filter[len(filter)-1]; last.Code != unix.BPF_RET|unix.BPF_K || last.K == 0 {
+			t.Fatal("filter doesn't end in accept")
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package internal
+
+import "errors"
+
+func openAFPacket(cfg InterfaceConfig) (PacketIO, error) {
+	return nil, errors.New("afpacket backend is only available on linux")
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+)
+
+const (
+	defaultAnnounceInterval = time.Minute
+	// linkPollInterval is how often the L2 interface state is checked for flaps and resume
+	linkPollInterval = 2 * time.Second
+	// wakeThreshold is how far the wall clock may run ahead of the monotonic one before it counts as a resume
+	wakeThreshold = 5 * time.Second
+)
+
+// AnnounceConfig refreshes the gateway address in LAN caches
+type AnnounceConfig struct {
+	// Interval between gratuitous ARP and unsolicited neighbor advertisements, 0 uses 1m
+	Interval Duration `json:"interval"`
+}
+
+// refreshPresence announces the gateway periodically, and at once when the L2 link
+// comes back up or the host resumes from sleep
+func (b *Bridge) refreshPresence(ctx context.Context, cfg AnnounceConfig) {
+	every := time.Duration(cfg.Interval)
+	if every <= 0 {
+		every = defaultAnnounceInterval
+	}
+
+	refresh := time.NewTicker(every)
+	defer refresh.Stop()
+	poll := time.NewTicker(linkPollInterval)
+	defer poll.Stop()
+
+	up := b.linkUp()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refresh.C:
+			if err := b.announcePresence(); err != nil {
+				slog.Error("announce presence error", "err", err)
+			}
+		case now := <-poll.C:
+			// Suspend stops the monotonic clock but not the wall clock
+			resumed := now.Round(0).Sub(last.Round(0))-now.Sub(last) > wakeThreshold
+			last = now
+
+			wasUp := up
+			up = b.linkUp()
+			if resumed || up && !wasUp {
+				slog.Info("L2 link is back, announcing gateway", "name", b.fromName, "resumed", resumed)
+				b.reannounce()
+			}
+		}
+	}
+}
+
+// linkUp reports whether the L2 interface is up and has a carrier
+func (b *Bridge) linkUp() bool {
+	iface, err := net.InterfaceByName(b.fromName)
+	if err != nil {
+		return false
+	}
+	return iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagRunning != 0
+}
+
+// reannounce refreshes every cache the gateway lives in: ARP, IPv6 neighbors and the default router
+func (b *Bridge) reannounce() {
+	if err := b.announcePresence(); err != nil {
+		slog.Error("announce presence error", "err", err)
+	}
+	if b.ra != nil {
+		b.sendRouterAdvert(*b.ra)
+	}
+}
@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+// registerAPI adds the bridge endpoints to the web UI server.
+// The ?bridge= query parameter picks a bridge by name, the first one is used without it.
+// The server listens on every interface, so endpoints that change a bridge go through authorize.
+func (a *App) registerAPI() {
+	http.HandleFunc("GET /api/neighbors", func(w http.ResponseWriter, r *http.Request) {
+		neighbors := []Neighbor{}
+		if b := a.bridgeFor(r); b != nil {
+			neighbors = b.Neighbors()
+		}
+		writeJSON(w, neighbors)
+	})
+
+	http.HandleFunc("GET /api/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := []ClientStats{}
+		if b := a.bridgeFor(r); b != nil {
+			stats = b.Stats()
+		}
+		writeJSON(w, stats)
+	})
+
+	http.HandleFunc("GET /api/router", func(w http.ResponseWriter, r *http.Request) {
+		var stats RouterStats
+		if b := a.bridgeFor(r); b != nil {
+			stats = b.RouterStats()
+		}
+		writeJSON(w, stats)
+	})
+
+	http.HandleFunc("GET /api/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.Status())
+	})
+
+	http.HandleFunc("GET /api/acl", func(w http.ResponseWriter, r *http.Request) {
+		st := ACLState{Pending: []PendingClient{}}
+		if b := a.bridgeFor(r); b != nil {
+			st = b.ACL()
+		} else {
+			a.mu.Lock()
+			cfg := a.Cfg.bridgeConfig(r.URL.Query().Get("bridge"))
+			if cfg != nil {
+				st.ACLConfig = cfg.ACL
+			}
+			a.mu.Unlock()
+			if cfg == nil {
+				http.Error(w, "unknown bridge", http.StatusNotFound)
+				return
+			}
+		}
+		writeJSON(w, st)
+	})
+
+	http.HandleFunc("PUT /api/acl", a.authorize(func(w http.ResponseWriter, r *http.Request) {
+		var cfg ACLConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := a.UpdateACL(r.URL.Query().Get("bridge"), cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// POST /api/acl/clients/{mac} with {"action": "allow"} or {"action": "deny"}
+	http.HandleFunc("POST /api/acl/clients/{mac}", a.authorize(func(w http.ResponseWriter, r *http.Request) {
+		mac, err := net.ParseMAC(r.PathValue("mac"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Action string `json:"action"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		b := a.bridgeFor(r)
+		if b == nil {
+			http.Error(w, "bridge is not running", http.StatusConflict)
+			return
+		}
+		if err := b.DecideClient(mac, req.Action); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.syncACL(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// authorize lets a request through from loopback, or from elsewhere with the api_token
+// as a bearer token. Requests from a bridged LAN are refused either way, or a client held
+// back by the ACL could approve itself.
+func (a *App) authorize(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := a.checkClient(r); err != nil {
+			slog.Warn("api request refused", "remote", r.RemoteAddr, "path", r.URL.Path, "err", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (a *App) checkClient(r *http.Request) error {
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return fmt.Errorf("unknown client address %q", r.RemoteAddr)
+	}
+	ip := addr.Addr().Unmap()
+
+	a.mu.Lock()
+	token := a.Cfg.APIToken
+	lan := a.Cfg.onBridgedLAN(ip)
+	a.mu.Unlock()
+
+	if lan {
+		return errors.New("not allowed from a bridged LAN")
+	}
+	if ip.IsLoopback() {
+		return nil
+	}
+	if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1 {
+		return nil
+	}
+	return errors.New("only allowed from localhost or with the api token")
+}
+
+// UpdateACL replaces the access control rules of the named bridge while it runs and for its next start
+func (a *App) UpdateACL(name string, cfg ACLConfig) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	bc := a.Cfg.bridgeConfig(name)
+	if bc == nil {
+		return fmt.Errorf("unknown bridge %q", name)
+	}
+
+	cfg.File = bc.ACL.File
+	if b := a.runningBridge(bc.Name); b != nil {
+		if err := b.UpdateACL(cfg); err != nil {
+			return err
+		}
+	} else {
+		validated := cfg
+		validated.File = ""
+		list, err := newAccessList(validated)
+		if err != nil {
+			return err
+		}
+		// The file overrides the config on the next start
+		list.cfg.File = cfg.File
+		list.save()
+	}
+
+	bc.ACL = cfg
+	return nil
+}
+
+// syncACL copies rules added on the bridge into the config used for the next start
+func (a *App) syncACL(b *Bridge) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if bc := a.Cfg.bridgeConfig(b.Name()); bc != nil {
+		bc.ACL = b.ACL().ACLConfig
+	}
+}
+
+// Status is the state shown by the web UI, the top level fields describe the first bridge
+type Status struct {
+	Running bool           `json:"running"`
+	LocalIP string         `json:"local_ip,omitempty"`
+	Error   string         `json:"error,omitempty"`
+	Bridges []BridgeStatus `json:"bridges"`
+}
+
+// BridgeStatus is the state of one bridged segment
+type BridgeStatus struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+	LocalIP string `json:"local_ip,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Status reports which bridges run and the error each is in, like an address conflict
+func (a *App) Status() Status {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	st := Status{Bridges: make([]BridgeStatus, 0, len(a.Cfg.Bridges))}
+	for _, cfg := range a.Cfg.Bridges {
+		bs := BridgeStatus{Name: cfg.Name}
+		if b := a.runningBridge(cfg.Name); b != nil {
+			bs.Running = true
+			bs.LocalIP = b.LocalIP().String()
+			if err := b.Err(); err != nil {
+				bs.Error = err.Error()
+			}
+		}
+		st.Bridges = append(st.Bridges, bs)
+	}
+
+	if len(st.Bridges) > 0 {
+		first := st.Bridges[0]
+		st.Running, st.LocalIP, st.Error = first.Running, first.LocalIP, first.Error
+	}
+	// A bridge that failed to start has no entry of its own to report it
+	if a.Err != nil && st.Error == "" {
+		st.Error = a.Err.Error()
+	}
+	return st
+}
+
+// Bridge returns the running bridge called name, the first one for an empty name,
+// nil while sing-box is stopped
+func (a *App) Bridge(name string) *Bridge {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.runningBridge(name)
+}
+
+// runningBridge is Bridge with mu held
+func (a *App) runningBridge(name string) *Bridge {
+	for _, b := range a.Bridges {
+		if name == "" || b.Name() == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// bridgeFor returns the bridge an API request is for
+func (a *App) bridgeFor(r *http.Request) *Bridge {
+	return a.Bridge(r.URL.Query().Get("bridge"))
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("write api response error", "err", err)
+	}
+}
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	a := &App{Cfg: Conf{APIToken: "secret", Bridges: []Config{testConfig()}}}
+	h := a.authorize(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name   string
+		remote string
+		token  string
+		want   int
+	}{
+		{"loopback", "127.0.0.1:40000", "", http.StatusNoContent},
+		{"loopback v6", "[::1]:40000", "", http.StatusNoContent},
+		{"remote without token", "192.168.1.5:40000", "", http.StatusForbidden},
+		{"remote with wrong token", "192.168.1.5:40000", "guess", http.StatusForbidden},
+		{"remote with token", "192.168.1.5:40000", "secret", http.StatusNoContent},
+		{"bridged LAN with token", "10.0.0.2:40000", "secret", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/api/acl", nil)
+			r.RemoteAddr = tt.remote
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
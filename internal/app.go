@@ -26,7 +26,8 @@ type App struct {
 	Cfg     Conf
 	Exec    string
 	Process *shell.Shell
-	Bridge  *Bridge
+	Bridges []*Bridge
+	Err     error // why a bridge failed to start
 	Ctx     context.Context
 	Stop    context.CancelFunc
 
@@ -54,6 +55,7 @@ func Run() {
 
 	go TrayOnReady()
 
+	app.registerAPI()
 	go func() {
 		if err := webui.StartServer(UIPort); err != nil {
 			log.Fatal(err)
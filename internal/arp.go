@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+
+	"github.com/DaniilSokolyuk/sing-vnet/arpr"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// ARPConfig decides which ARP requests the gateway answers, by default only those for LocalIP
+type ARPConfig struct {
+	// ProxyRanges are answered with the gateway MAC unless the address is a known LAN neighbor
+	ProxyRanges []string `json:"proxy_ranges"`
+	// Static maps IPv4 addresses to the MAC answered for them and used to reach them
+	Static map[string]string `json:"static"`
+}
+
+type arpPolicy struct {
+	proxy  []*net.IPNet
+	static map[netip.Addr]net.HardwareAddr
+}
+
+func newARPPolicy(cfg ARPConfig) (*arpPolicy, error) {
+	p := &arpPolicy{static: make(map[netip.Addr]net.HardwareAddr)}
+
+	for _, s := range cfg.ProxyRanges {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil || network.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid proxy range: %s", s)
+		}
+		p.proxy = append(p.proxy, network)
+	}
+
+	for ip, mac := range cfg.Static {
+		addr := net.ParseIP(ip).To4()
+		if addr == nil {
+			return nil, fmt.Errorf("invalid static address: %s", ip)
+		}
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			return nil, fmt.Errorf("invalid static mac for %s: %w", ip, err)
+		}
+		// ParseMAC also takes EUI-64 and InfiniBand addresses, which don't fit an ethernet header
+		if len(hw) != 6 {
+			return nil, fmt.Errorf("invalid static mac for %s: %s is not an ethernet address", ip, mac)
+		}
+		p.static[neighborKey(addr)] = hw
+	}
+
+	return p, nil
+}
+
+// arpAnswer returns the MAC the gateway replies with for target, false to stay silent
+func (b *Bridge) arpAnswer(target net.IP) (net.HardwareAddr, bool) {
+	if target.Equal(b.localIP) {
+		return b.localMAC, true
+	}
+
+	if mac, ok := b.arp.static[neighborKey(target)]; ok {
+		return mac, true
+	}
+
+	for _, network := range b.arp.proxy {
+		if !network.Contains(target) {
+			continue
+		}
+		// A peer on the LAN answers for itself
+		if _, ok := b.GetMAC(neighborKey(target)); ok {
+			return nil, false
+		}
+		return b.localMAC, true
+	}
+
+	return nil, false
+}
+
+func (b *Bridge) handleARP(packet []byte) {
+	gPckt := gopacket.NewPacket(packet, layers.LayerTypeEthernet, gopacket.Default)
+	arpLayer, ok := gPckt.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok {
+		return
+	}
+
+	srcIP := net.IP(arpLayer.SourceProtAddress)
+	srcMAC := net.HardwareAddr(arpLayer.SourceHwAddress)
+	if srcIP.Equal(b.localIP) {
+		// The host answering for the gateway IP from its NIC MAC is not a conflict
+		if !b.ownMAC(srcMAC) {
+			b.addressConflict(srcMAC)
+		}
+		return
+	}
+
+	switch arpLayer.Operation {
+	case layers.ARPReply:
+		// Answers to our own requests resolve queued packets
+		if b.network.Contains(srcIP) && b.acl.allowed(srcMAC, srcIP) {
+			b.StoreMAC(neighborKey(srcIP), srcMAC)
+		}
+	case layers.ARPRequest:
+		target := net.IP(arpLayer.DstProtAddress)
+
+		// A probe for the gateway address is answered so the prober backs off (RFC 5227 2.1.1)
+		probe := srcIP.Equal(net.IPv4zero) && target.Equal(b.localIP)
+		if !b.network.Contains(srcIP) && !probe {
+			return
+		}
+		if !probe && b.acl.allowed(srcMAC, srcIP) {
+			b.StoreMAC(neighborKey(srcIP), srcMAC)
+		}
+
+		// Gratuitous ARP announces the sender, nobody answers it
+		if target.Equal(srcIP) {
+			return
+		}
+
+		mac, ok := b.arpAnswer(target)
+		if !ok {
+			return
+		}
+
+		reply, err := arpr.SendProxyReply(arpLayer, target, mac, b.localMAC)
+		if err != nil {
+			slog.Error("send arp reply error", "err", err)
+			return
+		}
+		b.from.Write(reply)
+	}
+}
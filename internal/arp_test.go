@@ -0,0 +1,20 @@
+package internal
+
+import "testing"
+
+func TestARPPolicyStaticMAC(t *testing.T) {
+	for _, tc := range []struct {
+		mac string
+		ok  bool
+	}{
+		{"02:00:00:00:00:03", true},
+		{"02:00:00:00:00:00:00:03", false},
+		{"00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01", false},
+		{"not a mac", false},
+	} {
+		_, err := newARPPolicy(ARPConfig{Static: map[string]string{"10.0.0.3": tc.mac}})
+		if (err == nil) != tc.ok {
+			t.Errorf("static mac %s: err %v", tc.mac, err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// defaultBatchSize is how many frames a forwarding loop reads and writes at once
+const defaultBatchSize = 32
+
+// readBatch reads frames from io, one at a time from backends that can't batch
+func readBatch(io PacketIO, frames [][]byte) int {
+	if r, ok := io.(BatchReader); ok && len(frames) > 1 {
+		return r.ReadBatch(frames)
+	}
+
+	frame := io.Read()
+	if frame == nil {
+		return 0
+	}
+	frames[0] = frame
+	return 1
+}
+
+// writeBatch writes frames to io, one at a time to backends that can't batch
+func writeBatch(io PacketIO, frames [][]byte) error {
+	if w, ok := io.(BatchWriter); ok && len(frames) > 1 {
+		return w.WriteBatch(frames)
+	}
+
+	for _, frame := range frames {
+		if err := io.Write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// txBatch gathers the frames one forwarding loop sends to io while it handles a read batch,
+// they go out together on flush. A nil txBatch writes every frame right away.
+type txBatch struct {
+	io     PacketIO
+	frames [][]byte
+	// bufs are pooled buffers in frames, they go back to pool after the flush
+	bufs []*[]byte
+	pool *sync.Pool
+}
+
+func newTxBatch(io PacketIO, size int, pool *sync.Pool) *txBatch {
+	return &txBatch{
+		io:     io,
+		frames: make([][]byte, 0, size),
+		bufs:   make([]*[]byte, 0, size),
+		pool:   pool,
+	}
+}
+
+// add queues frame, buf is the pooled buffer holding it or nil when the frame is borrowed
+// from the read batch, which outlives the flush
+func (t *txBatch) add(frame []byte, buf *[]byte) {
+	t.frames = append(t.frames, frame)
+	if buf != nil {
+		t.bufs = append(t.bufs, buf)
+	}
+	if len(t.frames) == cap(t.frames) {
+		t.flush()
+	}
+}
+
+func (t *txBatch) flush() {
+	if t == nil || len(t.frames) == 0 {
+		return
+	}
+
+	if err := writeBatch(t.io, t.frames); err != nil {
+		slog.Debug("write batch error", "frames", len(t.frames), "err", err)
+	}
+
+	for _, buf := range t.bufs {
+		t.pool.Put(buf)
+	}
+	clear(t.frames)
+	t.frames, t.bufs = t.frames[:0], t.bufs[:0]
+}
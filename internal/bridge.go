@@ -1,15 +1,22 @@
 package internal
 
 import (
+	"cmp"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/DaniilSokolyuk/sing-vnet/arpr"
+	"github.com/DaniilSokolyuk/sing-vnet/ndpr"
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 )
 
@@ -27,67 +34,287 @@ import (
 //}
 
 type Config struct {
-	FromInterface InterfaceConfig
-	ToInterface   InterfaceConfig
+	// Name tells bridges apart in the API and the logs, it defaults to the TUN name
+	Name          string             `json:"name"`
+	FromInterface InterfaceConfig    `json:"from"`
+	ToInterface   InterfaceConfig    `json:"to"`
+	RouterAdvert  RouterAdvertConfig `json:"router_advert"`
+	DHCP          DHCPConfig         `json:"dhcp"`
+	DNS           DNSConfig          `json:"dns"`
+	Neighbors     NeighborConfig     `json:"neighbors"`
+	ARP           ARPConfig          `json:"arp"`
+	Conflict      ConflictConfig     `json:"conflict_detection"`
+	Announce      AnnounceConfig     `json:"announce"`
+	ACL           ACLConfig          `json:"acl"`
+	Ping          PingConfig         `json:"ping"`
+	MSSClamp      MSSConfig          `json:"mss_clamp"`
+	Router        RouterConfig       `json:"router"`
+	// BatchSize is how many frames the forwarding loops read and write per system call
+	// on backends that support it, 0 is 32 and 1 turns batching off
+	BatchSize int `json:"batch_size"`
+	// Workers is how many goroutines forward each direction, 0 is 1. Flows are spread over them
+	// by the kernel on af_packet, otherwise by a flow hash of each packet.
+	Workers int `json:"workers"`
+	// GatewayMAC is the MAC the gateway uses on the LAN, empty keeps the NIC MAC and "auto"
+	// derives a locally administered one. Wi-Fi usually drops frames from a MAC that isn't associated.
+	GatewayMAC string `json:"gateway_mac"`
 }
 
 type InterfaceConfig struct {
-	Name    string
-	Network string
-	LocalIP string
+	Name string `json:"name"`
+	// Backend is "pcap" (default), or "afpacket" on linux
+	Backend string `json:"backend"`
+	// VLAN is the 802.1Q VLAN ID of the L2 side, 0 for untagged frames
+	VLAN    int    `json:"vlan"`
+	Network string `json:"network"`
+	LocalIP string `json:"local_ip"`
+	// Network6 and LocalIP6 enable the IPv6 data path, leave empty for IPv4 only
+	Network6 string `json:"network6"`
+	LocalIP6 string `json:"local_ip6"`
+}
+
+// RouterAdvertConfig makes LAN devices use the gateway as their IPv6 router via SLAAC
+type RouterAdvertConfig struct {
+	Enabled bool `json:"enabled"`
+	// Prefix defaults to FromInterface.Network6 and should match the sing-box tun inet6_address
+	Prefix string `json:"prefix"`
+	// RDNSS defaults to FromInterface.LocalIP6
+	RDNSS    []string `json:"rdnss"`
+	Lifetime Duration `json:"lifetime"`
+	Interval Duration `json:"interval"`
 }
 
 type Bridge struct {
-	from       *PCAP // en0 - L2 interface
-	to         *PCAP // utun128 - L3 interface
-	ipMacTable map[string]net.HardwareAddr
-	mapMux     sync.RWMutex
+	name string
+	from PacketIO // en0 - L2 interface
+	to   PacketIO // utun128 - L3 interface
+	addressing
+	fromName string
+	localMAC net.HardwareAddr
+	// hostMAC is the MAC of the L2 NIC, the host's own frames use it
+	hostMAC    net.HardwareAddr
+	linkLocal  net.IP
+	tunFraming Framing
+	dhcp       *dhcpServer
+	dns        *dnsResponder
+	arp        *arpPolicy
+	acl        *accessList
+	stats      *trafficStats
+	conflict   conflictState
 	stop       context.CancelFunc
+	wg         sync.WaitGroup
+
+	// neighbors maps IPs to MACs on the L2 side, guarded by mapMux
+	neighbors   map[netip.Addr]*neighbor
+	neighborCfg NeighborConfig
+	incomplete  int
+	mapMux      sync.RWMutex
+
+	ra       *ndpr.RouterAdvert
+	raEvery  time.Duration
+	raSolMux sync.Mutex
+	raSolAt  time.Time
+
+	pingID    uint16
+	pingEvery time.Duration
+
+	// mss4 and mss6 are the TCP MSS clamps, 0 when clamping is off
+	mss4 uint16
+	mss6 uint16
+
+	// mtuL2 and mtuL3 are the IP MTUs of the two sides, 0 when unknown
+	mtuL2 int
+	mtuL3 int
+
+	// ethHeader is the Ethernet header of frames from the gateway, frames holds the buffers they are built in
+	ethHeader [ethernetHeight]byte
+	frames    sync.Pool
+
+	batchSize int
+	workers   int
+	// fromQueues and toQueues start with from and to, the others were opened for the workers
+	fromQueues []PacketIO
+	toQueues   []PacketIO
+
+	// router decrements TTLs, see RouterConfig
+	router      bool
+	ttlExceeded atomic.Uint64
 }
 
-var (
-	bridgeMx sync.Mutex
-)
+// Open opens the packet backends for both interfaces and starts a bridge between them
+func Open(ctx context.Context, cfg Config) (*Bridge, error) {
+	from, err := OpenPacketIO(cfg.FromInterface)
+	if err != nil {
+		return nil, fmt.Errorf("create from pcap error: %w", err)
+	}
+
+	to, err := OpenPacketIO(cfg.ToInterface)
+	if err != nil {
+		from.Close()
+		return nil, fmt.Errorf("create to pcap error: %w", err)
+	}
+
+	return Start(ctx, cfg, from, to)
+}
 
-func Start(ctx context.Context, cfg Config) (*Bridge, error) {
+// Start bridges from (L2) and to (L3). The bridge owns both and closes them on Close or on error.
+func Start(ctx context.Context, cfg Config, from, to PacketIO) (*Bridge, error) {
 	ctx, cancel := context.WithCancel(ctx)
 
-	bridgeMx.Lock()
-	defer bridgeMx.Unlock()
+	var bridge *Bridge
+	fail := func(err error) (*Bridge, error) {
+		cancel()
+		// Background work started so far may be using the interfaces
+		if bridge != nil {
+			bridge.wg.Wait()
+			bridge.withdrawRouter()
+		}
+		from.Close()
+		to.Close()
+		return nil, err
+	}
 
-	from, err := NewPCAP(cfg.FromInterface)
+	addrs, err := parseAddressing(cfg.FromInterface)
 	if err != nil {
-		cancel()
-		return nil, fmt.Errorf("create from pcap error: %w", err)
+		return fail(fmt.Errorf("from interface config error: %w", err))
+	}
+
+	// ARP and neighbor discovery need MAC addresses, the L3 side can be any supported framing
+	if lt := from.LinkType(); lt != layers.LinkTypeEthernet {
+		return fail(fmt.Errorf("L2 interface must be ethernet, got %s", lt))
 	}
 
-	to, err := NewPCAP(cfg.ToInterface)
+	tunFraming, err := framingFor(to)
 	if err != nil {
-		cancel()
-		return nil, fmt.Errorf("create to pcap error: %w", err)
+		return fail(fmt.Errorf("to interface framing error: %w", err))
+	}
+
+	localMAC, err := gatewayMAC(cfg.GatewayMAC, from.MAC(), addrs.localIP)
+	if err != nil {
+		return fail(fmt.Errorf("gateway mac error: %w", err))
 	}
+	if f, ok := from.(MACFilter); ok {
+		if err := f.SetMACFilter(localMAC); err != nil {
+			return fail(fmt.Errorf("from interface mac filter error: %w", err))
+		}
+	}
+	name := cfg.Name
+	if name == "" {
+		name = cfg.ToInterface.Name
+	}
+	slog.Info("Gateway address", "bridge", name, "ip", addrs.localIP, "mac", localMAC.String(), "vlan", cfg.FromInterface.VLAN)
 
-	bridge := &Bridge{
+	bridge = &Bridge{
+		name:       name,
 		from:       from,
 		to:         to,
-		ipMacTable: make(map[string]net.HardwareAddr),
+		addressing: addrs,
+		fromName:   cfg.FromInterface.Name,
+		localMAC:   localMAC,
+		hostMAC:    from.MAC(),
+		linkLocal:  ndpr.LinkLocal(localMAC),
+		tunFraming: tunFraming,
+		neighbors:  make(map[netip.Addr]*neighbor),
+		stats:      newTrafficStats(),
+		router:     cfg.Router.Enabled,
+		batchSize:  cmp.Or(max(cfg.BatchSize, 0), defaultBatchSize),
+		workers:    max(cfg.Workers, 1),
 		stop:       cancel,
 	}
 
+	copy(bridge.ethHeader[6:12], localMAC)
+	frameSize := ethernetHeight + max(from.MTU(), to.MTU(), header.IPv6MinimumMTU)
+	bridge.frames.New = func() any {
+		buf := make([]byte, 0, frameSize)
+		return &buf
+	}
+
+	if err := bridge.setupNeighbors(cfg.Neighbors); err != nil {
+		return fail(fmt.Errorf("neighbor cache error: %w", err))
+	}
+
+	bridge.acl, err = newAccessList(cfg.ACL)
+	if err != nil {
+		return fail(fmt.Errorf("acl config error: %w", err))
+	}
+
+	bridge.arp, err = newARPPolicy(cfg.ARP)
+	if err != nil {
+		return fail(fmt.Errorf("arp config error: %w", err))
+	}
+	for ip, mac := range bridge.arp.static {
+		bridge.staticNeighbor(ip, mac)
+	}
+
+	// Everything below uses the gateway address, so it is settled first
+	if cfg.Conflict.Enabled {
+		if err := bridge.claimAddress(ctx, cfg.Conflict); err != nil {
+			return fail(fmt.Errorf("claim gateway address error: %w", err))
+		}
+	}
+
+	if cfg.DHCP.Enabled {
+		bridge.dhcp, err = newDHCPServer(cfg.DHCP, bridge.network, bridge.localIP)
+		if err != nil {
+			return fail(fmt.Errorf("dhcp config error: %w", err))
+		}
+
+		for _, lease := range bridge.dhcp.Leases() {
+			mac, err := net.ParseMAC(lease.MAC)
+			if err == nil {
+				bridge.seedNeighbor(neighborKey(lease.IP), mac, time.Now())
+			}
+		}
+	}
+
+	if cfg.DNS.Enabled {
+		bridge.dns, err = newDNSResponder(cfg.DNS)
+		if err != nil {
+			return fail(fmt.Errorf("dns config error: %w", err))
+		}
+	}
+
+	if cfg.RouterAdvert.Enabled {
+		if err := bridge.setupRouterAdvert(cfg.RouterAdvert); err != nil {
+			return fail(fmt.Errorf("router advert config error: %w", err))
+		}
+		bridge.goBackground(func() { bridge.advertiseRouter(ctx) })
+	}
+
 	// Send initial gratuitous ARP only for the L2 interface (en0)
 	if err := bridge.announcePresence(); err != nil {
-		cancel()
-		return nil, fmt.Errorf("announce presence error: %w", err)
+		return fail(fmt.Errorf("announce presence error: %w", err))
 	}
-
-	go bridge.handleTraffic(ctx)
+	// RFC 5227 announces twice so a lost frame doesn't leave stale caches behind
+	bridge.goBackground(func() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(announceInterval):
+			bridge.announcePresence()
+		}
+	})
+	bridge.goBackground(func() { bridge.refreshPresence(ctx, cfg.Announce) })
+
+	bridge.goBackground(func() { bridge.maintainNeighbors(ctx) })
+	bridge.goBackground(func() { bridge.stats.sampleStats(ctx) })
+	bridge.setupMTU()
+	bridge.setupPing(cfg.Ping)
+	if cfg.MSSClamp.Enabled {
+		bridge.setupMSSClamp(cfg.MSSClamp)
+	}
+	if cfg.Ping.Enabled {
+		bridge.goBackground(func() { bridge.pingNeighbors(ctx) })
+	}
+	bridge.fromQueues = openQueues(from, bridge.workers)
+	bridge.toQueues = openQueues(to, bridge.workers)
+	slog.Info("Forwarding workers", "bridge", name, "workers", bridge.workers,
+		"l2_queues", len(bridge.fromQueues), "l3_queues", len(bridge.toQueues))
+	bridge.goBackground(func() { bridge.handleTraffic(ctx) })
 
 	return bridge, nil
 }
 
 const (
-	tunHeaderSize  = 4
-	tunHeader      = "\x02\x00\x00\x00"
 	ethernetHeight = 14
 )
 
@@ -98,148 +325,409 @@ func (b *Bridge) handleTraffic(ctx context.Context) {
 	// Handle traffic from L2 (en0) to L3 (utun128)
 	go func() {
 		defer wg.Done()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				packet := b.from.Read()
-				if packet == nil {
-					continue
+		b.runLane(ctx, lane{
+			in:   b.fromQueues,
+			out:  b.toQueues,
+			flow: flowL2,
+			handle: func(tx *txBatch, packet []byte) {
+				if len(packet) >= ethernetHeight {
+					b.handleL2(ctx, tx, packet)
 				}
+			},
+		}, b.workers)
+	}()
 
-				ethPacket := header.Ethernet(packet)
-				switch ethPacket.Type() {
-				case header.ARPProtocolNumber:
-					b.handleARP(packet)
-				case header.IPv4ProtocolNumber:
-					// Store the source MAC for future responses
-					ipHeader := header.IPv4(packet[14:])
-					srcIP := ipHeader.SourceAddress()
+	// Handle traffic from L3 (utun128) to L2 (en0)
+	go func() {
+		defer wg.Done()
+		b.runLane(ctx, lane{
+			in:     b.toQueues,
+			out:    b.fromQueues,
+			pool:   &b.frames,
+			flow:   b.flowL3,
+			handle: b.handleL3,
+		}, b.workers)
+	}()
 
-					if !b.from.network.Contains(srcIP.AsSlice()) {
-						continue
-					}
+	wg.Wait()
+}
 
-					//store
-					b.StoreMAC(srcIP.String(), []byte(ethPacket.SourceAddress()))
+// handleL2 handles a frame from the L2 side. The frame is borrowed from the backend,
+// it may be changed in place but anything kept after handleL2 returns must be copied.
+func (b *Bridge) handleL2(ctx context.Context, tx *txBatch, packet []byte) {
+	ethPacket := header.Ethernet(packet)
+	if !forGateway(packet[:6], b.localMAC) {
+		return
+	}
 
-					//gPckt := gopacket.NewPacket(ipHeader, layers.LayerTypeIPv4, gopacket.Default)
-					//fmt.Println("FROM L2>L3", gPckt.String(), packet, "\n")
+	switch ethPacket.Type() {
+	case header.ARPProtocolNumber:
+		b.handleARP(packet)
+	case header.IPv4ProtocolNumber:
+		if len(packet) < ethernetHeight+header.IPv4MinimumSize {
+			return
+		}
 
-					// Forward to L3 interface
-					copy(packet[ethernetHeight-tunHeaderSize:ethernetHeight], tunHeader)
-					b.to.Write(packet[ethernetHeight-tunHeaderSize:])
-				}
-			}
+		// Store the source MAC for future responses
+		ipHeader := header.IPv4(packet[14:])
+		if b.dhcp != nil && isDHCPRequest(ipHeader) {
+			b.handleDHCP(packet)
+			return
 		}
-	}()
 
-	// Handle traffic from L3 (utun128) to L2 (en0)
-	go func() {
-		defer wg.Done()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				packet := b.to.Read()
-				if packet == nil {
-					continue
-				}
-				// Add L2 header for en0
-				ipHeader := header.IPv4(packet[4:])
-				//srcIP := ipHeader.SourceAddress().String()
-				dstIP := ipHeader.DestinationAddress().String()
-
-				// Look up destination MAC
-				dstMAC, ok := b.GetMAC(dstIP)
-				if !ok {
-					continue
-				}
+		srcIP := net.IP(ipHeader.SourceAddressSlice())
 
-				//gPckt1 := gopacket.NewPacket(packet[4:], layers.LayerTypeIPv4, gopacket.Default)
-				//fmt.Println("TO L3>L2", gPckt1.String(), packet, "\n")
+		if !b.network.Contains(srcIP) {
+			return
+		}
 
-				// Create ethernet frame
-				eth := &layers.Ethernet{
-					SrcMAC:       b.from.localMAC,
-					DstMAC:       dstMAC,
-					EthernetType: layers.EthernetTypeIPv4,
-				}
+		// Store the source MAC only for clients the ACL lets through, denied ones can't churn the cache
+		allowed := b.acl.allowed(net.HardwareAddr(packet[6:12]), srcIP)
+		if allowed {
+			b.StoreMAC(neighborKey(srcIP), net.HardwareAddr(packet[6:12]))
+		}
 
-				// Serialize packet with ethernet header
-				buffer := gopacket.NewSerializeBuffer()
-				opts := gopacket.SerializeOptions{
-					FixLengths:       true,
-					ComputeChecksums: true,
-				}
+		if !allowed {
+			return
+		}
 
-				err := gopacket.SerializeLayers(buffer, opts,
-					eth,
-					gopacket.Payload(ipHeader), // Only use the IP packet part
-				)
-				if err != nil {
-					slog.Error("failed to serialize packet", "err", err)
-					continue
-				}
+		// The gateway answers pings itself, sing-box would drop them
+		if b.isGatewayEcho(header.IPv4ProtocolNumber, ipHeader) {
+			b.handleEcho(packet)
+			return
+		}
 
-				b.from.Write(buffer.Bytes())
-			}
+		if b.dns != nil && b.isGatewayDNS(header.IPv4ProtocolNumber, ipHeader) && b.handleDNS(ctx, packet) {
+			return
 		}
-	}()
 
-	wg.Wait()
+		//gPckt := gopacket.NewPacket(ipHeader, layers.LayerTypeIPv4, gopacket.Default)
+		//fmt.Println("FROM L2>L3", gPckt.String(), packet, "\n")
+
+		// Forward to L3 interface
+		if !b.routeL3(packet, ethernetHeight, header.IPv4ProtocolNumber) {
+			return
+		}
+		b.clampMSS(header.IPv4ProtocolNumber, ipHeader)
+		b.stats.account(packet[6:12], len(ipHeader), true)
+		b.forwardL3(tx, packet, ethernetHeight, header.IPv4ProtocolNumber)
+	case header.IPv6ProtocolNumber:
+		if b.network6 == nil || len(packet) < ethernetHeight+header.IPv6MinimumSize {
+			return
+		}
+
+		ipHeader := header.IPv6(packet[14:])
+		if ipHeader.TransportProtocol() == header.ICMPv6ProtocolNumber && b.handleNDP(packet) {
+			return
+		}
+
+		srcIP := net.IP(ipHeader.SourceAddressSlice())
+		if !b.network6.Contains(srcIP) {
+			return
+		}
+
+		allowed := b.acl.allowed(net.HardwareAddr(packet[6:12]), srcIP)
+		if allowed {
+			b.StoreMAC(neighborKey(srcIP), net.HardwareAddr(packet[6:12]))
+		}
+
+		if !allowed {
+			return
+		}
+
+		if b.isGatewayEcho(header.IPv6ProtocolNumber, ipHeader) {
+			b.handleEcho(packet)
+			return
+		}
+
+		if b.dns != nil && b.isGatewayDNS(header.IPv6ProtocolNumber, ipHeader) && b.handleDNS(ctx, packet) {
+			return
+		}
+
+		if !b.routeL3(packet, ethernetHeight, header.IPv6ProtocolNumber) {
+			return
+		}
+		b.clampMSS(header.IPv6ProtocolNumber, ipHeader)
+		b.stats.account(packet[6:12], len(ipHeader), true)
+		b.forwardL3(tx, packet, ethernetHeight, header.IPv6ProtocolNumber)
+	}
+}
+
+// handleL3 handles a packet from the TUN, which is borrowed like the frames of handleL2
+func (b *Bridge) handleL3(tx *txBatch, packet []byte) {
+	proto, ipHeader, ok := b.tunFraming.Decode(packet)
+	if !ok {
+		return
+	}
+
+	// Add L2 header for en0
+	var dst net.IP
+	var local bool
+	switch proto {
+	case header.IPv4ProtocolNumber:
+		if len(ipHeader) < header.IPv4MinimumSize {
+			return
+		}
+		dst = header.IPv4(ipHeader).DestinationAddressSlice()
+		local = b.network.Contains(dst) && !dst.Equal(b.broadcast)
+	case header.IPv6ProtocolNumber:
+		if len(ipHeader) < header.IPv6MinimumSize {
+			return
+		}
+		dst = header.IPv6(ipHeader).DestinationAddressSlice()
+		local = b.network6 != nil && b.network6.Contains(dst)
+	default:
+		return
+	}
+	if !b.routeL2(proto, ipHeader) {
+		return
+	}
+	dstIP := neighborKey(dst)
+	b.clampMSS(proto, ipHeader)
+
+	// Look up destination MAC
+	dstMAC, ok := b.GetMAC(dstIP)
+	if !ok {
+		// Hold the packet while the LAN is asked for the destination
+		if local {
+			b.queuePending(dstIP, proto, ipHeader)
+		}
+		return
+	}
+
+	//gPckt1 := gopacket.NewPacket(packet[4:], layers.LayerTypeIPv4, gopacket.Default)
+	//fmt.Println("TO L3>L2", gPckt1.String(), packet, "\n")
+
+	b.forwardL2(tx, dstMAC, proto, ipHeader)
+}
+
+// writeL2 sends the IP packet to dstMAC on the L2 side
+func (b *Bridge) writeL2(dstMAC net.HardwareAddr, proto tcpip.NetworkProtocolNumber, packet []byte) {
+	b.sendL2(nil, dstMAC, proto, packet)
+}
+
+// sendL2 is writeL2 through the batch of a forwarding loop
+func (b *Bridge) sendL2(tx *txBatch, dstMAC net.HardwareAddr, proto tcpip.NetworkProtocolNumber, packet []byte) {
+	buf := b.frames.Get().(*[]byte)
+
+	// The source MAC is already in place, only the destination and type change per packet
+	frame := append((*buf)[:0], b.ethHeader[:]...)
+	copy(frame, dstMAC)
+	binary.BigEndian.PutUint16(frame[12:], uint16(proto))
+	frame = append(frame, packet...)
+	*buf = frame
+
+	b.stats.account(dstMAC, len(packet), false)
+	if tx != nil {
+		tx.add(frame, buf)
+		return
+	}
+
+	if err := b.from.Write(frame); err != nil {
+		slog.Debug("write l2 error", "err", err)
+	}
+	b.frames.Put(buf)
+}
+
+// gatewayPayload returns the transport protocol and payload of an IP packet addressed to the gateway
+func (b *Bridge) gatewayPayload(proto tcpip.NetworkProtocolNumber, packet []byte) (tcpip.TransportProtocolNumber, []byte, bool) {
+	switch proto {
+	case header.IPv4ProtocolNumber:
+		ip := header.IPv4(packet)
+		if !ip.IsValid(len(packet)) || !net.IP(ip.DestinationAddressSlice()).Equal(b.localIP) {
+			return 0, nil, false
+		}
+		return ip.TransportProtocol(), ip.Payload(), true
+	case header.IPv6ProtocolNumber:
+		ip := header.IPv6(packet)
+		if !ip.IsValid(len(packet)) {
+			return 0, nil, false
+		}
+		dst := net.IP(ip.DestinationAddressSlice())
+		if !dst.Equal(b.localIP6) && !dst.Equal(b.linkLocal) {
+			return 0, nil, false
+		}
+		return ip.TransportProtocol(), ip.Payload(), true
+	default:
+		return 0, nil, false
+	}
+}
+
+// writeL3 frames the IP packet at frame[off:] for the L3 side, reusing the headroom before off
+func (b *Bridge) writeL3(frame []byte, off int, proto tcpip.NetworkProtocolNumber) error {
+	return b.sendL3(nil, frame, off, proto)
 }
 
-func (b *Bridge) handleARP(packet []byte) {
+// sendL3 is writeL3 through the batch of a forwarding loop, frame must stay valid until the flush
+func (b *Bridge) sendL3(tx *txBatch, frame []byte, off int, proto tcpip.NetworkProtocolNumber) error {
+	hl := b.tunFraming.HeaderLen()
+	if off < hl {
+		buf := make([]byte, hl+len(frame)-off)
+		copy(buf[hl:], frame[off:])
+		frame, off = buf, hl
+	}
+
+	b.tunFraming.Encode(frame[off-hl:off], proto)
+	if tx != nil {
+		tx.add(frame[off-hl:], nil)
+		return nil
+	}
+	return b.to.Write(frame[off-hl:])
+}
+
+// handleNDP answers neighbor solicitations for the gateway and learns neighbors.
+// It reports whether the packet was neighbor discovery and must not be forwarded.
+func (b *Bridge) handleNDP(packet []byte) bool {
 	gPckt := gopacket.NewPacket(packet, layers.LayerTypeEthernet, gopacket.Default)
-	arpLayer, ok := gPckt.Layer(layers.LayerTypeARP).(*layers.ARP)
+	ip6, ok := gPckt.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !ok {
+		return false
+	}
+
+	icmp, ok := gPckt.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
 	if !ok {
+		return false
+	}
+
+	switch icmp.TypeCode.Type() {
+	case layers.ICMPv6TypeNeighborSolicitation:
+		ndp, ok := gPckt.Layer(layers.LayerTypeICMPv6NeighborSolicitation).(*layers.ICMPv6NeighborSolicitation)
+		if !ok {
+			return true
+		}
+
+		srcMAC := ndpLinkAddress(ndp.Options, layers.ICMPv6OptSourceAddress)
+		if srcMAC != nil && !ip6.SrcIP.IsUnspecified() {
+			b.storeNeighbor(ip6.SrcIP, srcMAC)
+		}
+
+		if !ndp.TargetAddress.Equal(b.localIP6) && !ndp.TargetAddress.Equal(ndpr.LinkLocal(b.localMAC)) {
+			return true
+		}
+
+		// Duplicate address detection probes come from :: and are answered to all nodes
+		var dstIP net.IP
+		var dstMAC net.HardwareAddr
+		flags := uint8(ndpr.FlagRouter | ndpr.FlagOverride)
+		if !ip6.SrcIP.IsUnspecified() {
+			dstIP = ip6.SrcIP
+			dstMAC = net.HardwareAddr(header.Ethernet(packet).SourceAddress())
+			flags |= ndpr.FlagSolicited
+		}
+
+		reply, err := ndpr.SendNeighborAdvert(ndp.TargetAddress, b.localMAC, dstIP, dstMAC, flags)
+		if err != nil {
+			slog.Error("send neighbor advert error", "err", err)
+			return true
+		}
+		b.from.Write(reply)
+	case layers.ICMPv6TypeNeighborAdvertisement:
+		ndp, ok := gPckt.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(*layers.ICMPv6NeighborAdvertisement)
+		if !ok {
+			return true
+		}
+
+		mac := ndpLinkAddress(ndp.Options, layers.ICMPv6OptTargetAddress)
+		if mac == nil {
+			mac = net.HardwareAddr(header.Ethernet(packet).SourceAddress())
+		}
+		b.storeNeighbor(ndp.TargetAddress, mac)
+	case layers.ICMPv6TypeRouterSolicitation:
+		b.solicitedRouterAdvert()
+	case layers.ICMPv6TypeRouterAdvertisement, layers.ICMPv6TypeRedirect:
+	default:
+		return false
+	}
+
+	return true
+}
+
+// storeNeighbor remembers an IPv6 neighbor if it belongs to the bridged network and the ACL allows it.
+func (b *Bridge) storeNeighbor(ip net.IP, mac net.HardwareAddr) {
+	if !b.network6.Contains(ip) || !b.acl.allowed(mac, ip) {
 		return
 	}
 
-	if arpLayer.Operation == layers.ARPRequest {
-		srcIP := net.IP(arpLayer.SourceProtAddress)
-		if b.from.network.Contains(srcIP) {
-			reply, err := arpr.SendReply(arpLayer, b.from.localIP, b.from.localMAC)
-			if err != nil {
-				slog.Error("send arp reply error", "err", err)
-				return
-			}
-			b.from.Write(reply)
+	b.StoreMAC(neighborKey(ip), mac)
+}
 
-			srcMAC := net.HardwareAddr(arpLayer.SourceHwAddress)
-			b.StoreMAC(srcIP.To4().String(), srcMAC)
-			slog.Info("stored arp mapping", "ip", srcIP, "mac", srcMAC.String())
+func ndpLinkAddress(opts layers.ICMPv6Options, typ layers.ICMPv6Opt) net.HardwareAddr {
+	for _, opt := range opts {
+		if opt.Type == typ && len(opt.Data) == 6 {
+			return net.HardwareAddr(opt.Data)
 		}
 	}
+	return nil
 }
 
 func (b *Bridge) announcePresence() error {
 	// Only send gratuitous ARP on the L2 interface
-	arpPacket, err := arpr.SendGratuitousArp(b.from.localIP, b.from.localMAC)
+	arpPacket, err := arpr.SendGratuitousArp(b.localIP, b.localMAC)
+	if err != nil {
+		return err
+	}
+	if err := b.from.Write(arpPacket); err != nil {
+		return err
+	}
+
+	if b.localIP6 == nil {
+		return nil
+	}
+
+	naPacket, err := ndpr.SendNeighborAdvert(b.localIP6, b.localMAC, nil, nil, ndpr.FlagRouter|ndpr.FlagOverride)
 	if err != nil {
 		return err
 	}
-	return b.from.Write(arpPacket)
+	return b.from.Write(naPacket)
 }
 
-func (b *Bridge) StoreMAC(ip string, mac net.HardwareAddr) {
-	b.mapMux.Lock()
-	defer b.mapMux.Unlock()
-	b.ipMacTable[ip] = mac
+// goBackground runs fn in a goroutine that Close waits for
+func (b *Bridge) goBackground(fn func()) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		fn()
+	}()
 }
 
-func (b *Bridge) GetMAC(ip string) (net.HardwareAddr, bool) {
-	b.mapMux.RLock()
-	defer b.mapMux.RUnlock()
-	mac, ok := b.ipMacTable[ip]
-	return mac, ok
+// ACL returns the access control rules and the clients waiting for approval
+func (b *Bridge) ACL() ACLState {
+	return b.acl.State()
+}
+
+// UpdateACL replaces the access control rules while the bridge runs
+func (b *Bridge) UpdateACL(cfg ACLConfig) error {
+	return b.acl.Update(cfg)
+}
+
+// DecideClient allows or denies a client waiting for approval
+func (b *Bridge) DecideClient(mac net.HardwareAddr, action string) error {
+	return b.acl.Decide(mac, action)
+}
+
+// Leases returns the active DHCP leases, nil when the server is disabled
+func (b *Bridge) Leases() []DHCPLease {
+	if b.dhcp == nil {
+		return nil
+	}
+	return b.dhcp.Leases()
+}
+
+// Name returns the bridge name from Config.Name
+func (b *Bridge) Name() string {
+	return b.name
 }
 
 func (b *Bridge) Close() {
 	b.stop()
-	b.from.Close()
-	b.to.Close()
+	// Backends return from Read within readTimeout and from Write within writeTimeout,
+	// so no frame is in use once they close
+	b.wg.Wait()
+	b.withdrawRouter()
+	b.saveNeighbors()
+	for _, queues := range [][]PacketIO{b.fromQueues, b.toQueues} {
+		for _, queue := range queues {
+			queue.Close()
+		}
+	}
 }
@@ -0,0 +1,400 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+var (
+	testNICMAC    = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	testClientMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	testPeerMAC   = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x03}
+	testGatewayIP = net.IPv4(10, 0, 0, 1).To4()
+	testClientIP  = net.IPv4(10, 0, 0, 2).To4()
+	testPeerIP    = net.IPv4(10, 0, 0, 3).To4()
+	testRemoteIP  = net.IPv4(8, 8, 8, 8).To4()
+)
+
+func testConfig() Config {
+	return Config{
+		FromInterface: InterfaceConfig{Network: "10.0.0.0/24", LocalIP: testGatewayIP.String()},
+		ToInterface:   InterfaceConfig{Network: "10.0.0.0/24", LocalIP: testGatewayIP.String()},
+	}
+}
+
+// startTestBridge runs a bridge between two pipes and returns it with the LAN and TUN ends
+func startTestBridge(tb testing.TB, cfg Config) (b *Bridge, lan, tun *Pipe) {
+	tb.Helper()
+	return startTestBridgeMTU(tb, cfg, 1500, 1500)
+}
+
+// startTestBridgeMTU is startTestBridge with the MTUs of the LAN and TUN
+func startTestBridgeMTU(tb testing.TB, cfg Config, mtuL2, mtuL3 int) (b *Bridge, lan, tun *Pipe) {
+	tb.Helper()
+
+	from, lan := NewPipe(layers.LinkTypeEthernet, mtuL2, testNICMAC)
+	to, tun := NewPipe(layers.LinkTypeRaw, mtuL3, nil)
+
+	b, err := Start(context.Background(), cfg, from, to)
+	if err != nil {
+		tb.Fatalf("start bridge: %v", err)
+	}
+	tb.Cleanup(b.Close)
+	return b, lan, tun
+}
+
+func serialize(tb testing.TB, l ...gopacket.SerializableLayer) []byte {
+	tb.Helper()
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		tb.Fatalf("serialize: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func arpFrame(tb testing.TB, op uint16, srcMAC net.HardwareAddr, srcIP, dstIP net.IP, dstMAC net.HardwareAddr) []byte {
+	eth := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeARP}
+	if op == layers.ARPRequest {
+		eth.DstMAC = layers.EthernetBroadcast
+		dstMAC = net.HardwareAddr{0, 0, 0, 0, 0, 0}
+	}
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         op,
+		SourceHwAddress:   srcMAC,
+		SourceProtAddress: srcIP,
+		DstHwAddress:      dstMAC,
+		DstProtAddress:    dstIP,
+	}
+	return serialize(tb, eth, arp)
+}
+
+func udpLayers(src, dst net.IP, payload string) []gopacket.SerializableLayer {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src, DstIP: dst}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	return []gopacket.SerializableLayer{ip, udp, gopacket.Payload(payload)}
+}
+
+func udpFrame(tb testing.TB, srcMAC, dstMAC net.HardwareAddr, src, dst net.IP, payload string) []byte {
+	eth := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv4}
+	return serialize(tb, append([]gopacket.SerializableLayer{eth}, udpLayers(src, dst, payload)...)...)
+}
+
+func udpPacket(tb testing.TB, src, dst net.IP, payload string) []byte {
+	return serialize(tb, udpLayers(src, dst, payload)...)
+}
+
+// expect reads p until a frame matches, skipping the announcements the bridge sends on its own
+func expect(tb testing.TB, p *Pipe, first gopacket.Decoder, match func(gopacket.Packet) bool) gopacket.Packet {
+	tb.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		frame := p.Read()
+		if frame == nil {
+			continue
+		}
+		packet := gopacket.NewPacket(frame, first, gopacket.Default)
+		p.Release()
+		if match(packet) {
+			return packet
+		}
+	}
+	tb.Fatal("no matching frame")
+	return nil
+}
+
+func isUDP(src, dst net.IP, payload string) func(gopacket.Packet) bool {
+	return func(p gopacket.Packet) bool {
+		ip, ok := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		udp, _ := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		return ok && udp != nil && ip.SrcIP.Equal(src) && ip.DstIP.Equal(dst) && string(udp.Payload) == payload
+	}
+}
+
+func TestARPReplyForGateway(t *testing.T) {
+	_, lan, _ := startTestBridge(t, testConfig())
+
+	lan.Write(arpFrame(t, layers.ARPRequest, testClientMAC, testClientIP, testGatewayIP, nil))
+
+	expect(t, lan, layers.LayerTypeEthernet, func(p gopacket.Packet) bool {
+		arp, ok := p.Layer(layers.LayerTypeARP).(*layers.ARP)
+		return ok && arp.Operation == layers.ARPReply &&
+			net.IP(arp.SourceProtAddress).Equal(testGatewayIP) &&
+			bytes.Equal(arp.SourceHwAddress, testNICMAC) &&
+			bytes.Equal(arp.DstHwAddress, testClientMAC)
+	})
+}
+
+func TestARPIgnoresOtherTargets(t *testing.T) {
+	_, lan, _ := startTestBridge(t, testConfig())
+
+	lan.Write(arpFrame(t, layers.ARPRequest, testClientMAC, testClientIP, testPeerIP, nil))
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		frame := lan.Read()
+		if frame == nil {
+			continue
+		}
+		packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		lan.Release()
+		if arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP); ok && arp.Operation == layers.ARPReply {
+			t.Fatalf("answered ARP for %s", net.IP(arp.SourceProtAddress))
+		}
+	}
+}
+
+func TestForwardL2ToL3(t *testing.T) {
+	_, lan, tun := startTestBridge(t, testConfig())
+
+	lan.Write(udpFrame(t, testClientMAC, testNICMAC, testClientIP, testRemoteIP, "query"))
+
+	expect(t, tun, layers.LayerTypeIPv4, isUDP(testClientIP, testRemoteIP, "query"))
+}
+
+func TestForwardL3ToL2(t *testing.T) {
+	_, lan, tun := startTestBridge(t, testConfig())
+
+	// The client's first packet teaches the bridge its MAC
+	lan.Write(udpFrame(t, testClientMAC, testNICMAC, testClientIP, testRemoteIP, "query"))
+	expect(t, tun, layers.LayerTypeIPv4, isUDP(testClientIP, testRemoteIP, "query"))
+
+	tun.Write(udpPacket(t, testRemoteIP, testClientIP, "answer"))
+
+	packet := expect(t, lan, layers.LayerTypeEthernet, isUDP(testRemoteIP, testClientIP, "answer"))
+	eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !bytes.Equal(eth.DstMAC, testClientMAC) || !bytes.Equal(eth.SrcMAC, testNICMAC) {
+		t.Fatalf("frame %s -> %s, want %s -> %s", eth.SrcMAC, eth.DstMAC, testNICMAC, testClientMAC)
+	}
+}
+
+func TestResolveUnknownNeighbor(t *testing.T) {
+	_, lan, tun := startTestBridge(t, testConfig())
+
+	tun.Write(udpPacket(t, testRemoteIP, testPeerIP, "answer"))
+
+	// The packet waits for the peer to answer the bridge's ARP request
+	expect(t, lan, layers.LayerTypeEthernet, func(p gopacket.Packet) bool {
+		arp, ok := p.Layer(layers.LayerTypeARP).(*layers.ARP)
+		return ok && arp.Operation == layers.ARPRequest && net.IP(arp.DstProtAddress).Equal(testPeerIP)
+	})
+	lan.Write(arpFrame(t, layers.ARPReply, testPeerMAC, testPeerIP, testGatewayIP, testNICMAC))
+
+	packet := expect(t, lan, layers.LayerTypeEthernet, isUDP(testRemoteIP, testPeerIP, "answer"))
+	if eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); !bytes.Equal(eth.DstMAC, testPeerMAC) {
+		t.Fatalf("queued packet sent to %s, want %s", eth.DstMAC, testPeerMAC)
+	}
+}
+
+func TestCloseWithStalledPeer(t *testing.T) {
+	from, lan := NewPipe(layers.LinkTypeEthernet, 1500, testNICMAC)
+	to, _ := NewPipe(layers.LinkTypeRaw, 1500, nil)
+	b, err := Start(context.Background(), testConfig(), from, to)
+	if err != nil {
+		t.Fatalf("start bridge: %v", err)
+	}
+
+	// Nobody reads the TUN end, its queue fills up
+	frame := udpFrame(t, testClientMAC, testNICMAC, testClientIP, testRemoteIP, "query")
+	for range 4 * pipeQueueSize {
+		for lan.Write(frame) == errPipeFull {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		b.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close hangs while the TUN end is not read")
+	}
+}
+
+func TestDeniedClientNotLearned(t *testing.T) {
+	cfg := testConfig()
+	cfg.ACL.Default = ACLDeny
+	b, lan, _ := startTestBridge(t, cfg)
+
+	lan.Write(udpFrame(t, testClientMAC, testNICMAC, testClientIP, testRemoteIP, "query"))
+	lan.Write(arpFrame(t, layers.ARPRequest, testClientMAC, testClientIP, testGatewayIP, nil))
+
+	// The reply to the later ARP request means both frames were handled
+	expect(t, lan, layers.LayerTypeEthernet, func(p gopacket.Packet) bool {
+		arp, ok := p.Layer(layers.LayerTypeARP).(*layers.ARP)
+		return ok && arp.Operation == layers.ARPReply
+	})
+	if n := b.Neighbors(); len(n) != 0 {
+		t.Fatalf("denied client learned: %+v", n)
+	}
+}
+
+func TestHostNICIsNoAddressConflict(t *testing.T) {
+	cfg := testConfig()
+	cfg.GatewayMAC = "auto"
+	b, lan, _ := startTestBridge(t, cfg)
+
+	// The host kernel answers for the gateway IP from the NIC MAC
+	lan.Write(arpFrame(t, layers.ARPReply, testNICMAC, testGatewayIP, testClientIP, layers.EthernetBroadcast))
+	lan.Write(arpFrame(t, layers.ARPRequest, testClientMAC, testClientIP, testGatewayIP, nil))
+	expect(t, lan, layers.LayerTypeEthernet, func(p gopacket.Packet) bool {
+		arp, ok := p.Layer(layers.LayerTypeARP).(*layers.ARP)
+		return ok && arp.Operation == layers.ARPReply && bytes.Equal(arp.DstHwAddress, testClientMAC)
+	})
+	if err := b.Err(); err != nil {
+		t.Fatalf("host NIC reported as conflict: %v", err)
+	}
+
+	lan.Write(arpFrame(t, layers.ARPReply, testPeerMAC, testGatewayIP, testClientIP, layers.EthernetBroadcast))
+	deadline := time.Now().Add(2 * time.Second)
+	for b.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b.Err() == nil {
+		t.Fatal("another host claiming the gateway IP is not a conflict")
+	}
+}
+
+// benchWindow bounds the frames in flight, below pipeQueueSize so the pipes never drop one
+const benchWindow = 64
+
+// benchForward writes b.N copies of frame to in and waits until the bridge delivered them to out,
+// frames of another length on out are the bridge's own and not counted
+func benchForward(b *testing.B, in, out *Pipe, frame []byte, want int) {
+	window := make(chan struct{}, benchWindow)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 0; n < b.N; {
+			packet := out.Read()
+			if packet == nil {
+				continue
+			}
+			if len(packet) == want {
+				<-window
+				n++
+			}
+			out.Release()
+		}
+	}()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	b.ResetTimer()
+	for range b.N {
+		window <- struct{}{}
+		if err := in.Write(frame); err != nil {
+			b.Fatalf("write: %v", err)
+		}
+	}
+	<-done
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "packets/s")
+}
+
+func BenchmarkL2ToL3(b *testing.B) {
+	_, lan, tun := startTestBridge(b, testConfig())
+	payload := string(make([]byte, 512))
+
+	frame := udpFrame(b, testClientMAC, testNICMAC, testClientIP, testRemoteIP, payload)
+	benchForward(b, lan, tun, frame, len(udpPacket(b, testClientIP, testRemoteIP, payload)))
+}
+
+func BenchmarkL3ToL2(b *testing.B) {
+	_, lan, tun := startTestBridge(b, testConfig())
+	payload := string(make([]byte, 512))
+
+	// The client's first packet teaches the bridge its MAC
+	lan.Write(udpFrame(b, testClientMAC, testNICMAC, testClientIP, testRemoteIP, "query"))
+	expect(b, tun, layers.LayerTypeIPv4, isUDP(testClientIP, testRemoteIP, "query"))
+
+	packet := udpPacket(b, testRemoteIP, testClientIP, payload)
+	benchForward(b, tun, lan, packet, len(udpFrame(b, testNICMAC, testClientMAC, testRemoteIP, testClientIP, payload)))
+}
+
+// stalledIO is a backend whose sends never return, like libpcap's on a link that doesn't drain
+type stalledIO struct {
+	*Pipe
+	writer *asyncWriter
+}
+
+func newStalledIO(tb testing.TB, p *Pipe) *stalledIO {
+	unblock := make(chan struct{})
+	tb.Cleanup(func() { close(unblock) })
+
+	send := func([]byte) error {
+		<-unblock
+		return nil
+	}
+	return &stalledIO{Pipe: p, writer: newAsyncWriter(send, 1500, func() {})}
+}
+
+func (s *stalledIO) Write(p []byte) error { return s.writer.Write(p) }
+
+func (s *stalledIO) Close() {
+	s.writer.Close()
+	s.Pipe.Close()
+}
+
+func TestCloseWithBlockedWrite(t *testing.T) {
+	from, lan := NewPipe(layers.LinkTypeEthernet, 1500, testNICMAC)
+	to, _ := NewPipe(layers.LinkTypeRaw, 1500, nil)
+	b, err := Start(context.Background(), testConfig(), from, newStalledIO(t, to))
+	if err != nil {
+		t.Fatalf("start bridge: %v", err)
+	}
+
+	// The first frame blocks in the send, the ones after it are dropped
+	frame := udpFrame(t, testClientMAC, testNICMAC, testClientIP, testRemoteIP, "query")
+	for range 8 {
+		lan.Write(frame)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		b.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(4 * writeTimeout):
+		t.Fatal("Close hangs while a write is blocked")
+	}
+}
+
+func TestDeniedClientNoEchoReply(t *testing.T) {
+	cfg := testConfig()
+	cfg.ACL.Default = ACLDeny
+	_, lan, _ := startTestBridge(t, cfg)
+
+	eth := &layers.Ethernet{SrcMAC: testClientMAC, DstMAC: testNICMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: testClientIP, DstIP: testGatewayIP}
+	icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 1, Seq: 1}
+	lan.Write(serialize(t, eth, ip, icmp))
+	lan.Write(arpFrame(t, layers.ARPRequest, testClientMAC, testClientIP, testGatewayIP, nil))
+
+	// The reply to the later ARP request means the ping was handled
+	expect(t, lan, layers.LayerTypeEthernet, func(p gopacket.Packet) bool {
+		if icmp, ok := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok && icmp.TypeCode.Type() == layers.ICMPv4TypeEchoReply {
+			t.Fatal("denied client got an echo reply")
+		}
+		arp, ok := p.Layer(layers.LayerTypeARP).(*layers.ARP)
+		return ok && arp.Operation == layers.ARPReply
+	})
+}
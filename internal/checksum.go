@@ -0,0 +1,17 @@
+package internal
+
+import "math/bits"
+
+// checksumUpdate adjusts an internet checksum for a 16-bit word changing from old to new (RFC 1624 eqn. 3).
+// odd is set when the word starts at an odd offset of the checksummed data.
+func checksumUpdate(sum, old, new uint16, odd bool) uint16 {
+	if odd {
+		// One's complement sums are byte order independent, a shifted word just swaps its bytes
+		old, new = bits.ReverseBytes16(old), bits.ReverseBytes16(new)
+	}
+
+	s := uint32(^sum) + uint32(^old) + uint32(new)
+	s = (s & 0xffff) + (s >> 16)
+	s = (s & 0xffff) + (s >> 16)
+	return ^uint16(s)
+}
@@ -1,9 +1,17 @@
 package internal
 
 import (
+	"cmp"
 	"encoding/json"
+	"fmt"
 	"log"
+	"log/slog"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
 )
 
 type Conf struct {
@@ -16,6 +24,56 @@ type Conf struct {
 		ExecPath     string `json:"exec_path"`
 		InboundTag   string `json:"inbound_tag"`
 	} `json:"sing"`
+	// Bridges are the bridged segments, like a trusted and a guest VLAN, each with its own sing-box tun inbound
+	Bridges []Config `json:"bridges"`
+	// APIToken lets clients other than localhost change bridges through the API, sent as
+	// "Authorization: Bearer <token>". Empty keeps those endpoints local.
+	APIToken string `json:"api_token"`
+	// Bridge is the only segment of configs without Bridges, defaultBridge when it is missing too
+	Bridge *Config `json:"bridge"`
+}
+
+// defaultBridge is the segment used before the bridge was configurable, en0 bridged to
+// the sing-box tun utun128
+func defaultBridge() Config {
+	return Config{
+		FromInterface: InterfaceConfig{
+			Name:     "en0",
+			Network:  "172.26.0.0/16",
+			LocalIP:  "172.26.0.1",
+			Network6: "fd26::/64",
+			LocalIP6: "fd26::1",
+		},
+		ToInterface: InterfaceConfig{
+			Name:     "utun128",
+			Network:  "172.26.0.0/16",
+			LocalIP:  "172.26.0.1",
+			Network6: "fd26::/64",
+			LocalIP6: "fd26::1",
+		},
+	}
+}
+
+// Duration is a time.Duration written as "30s" or "10m" in the config
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
 }
 
 func LoadConfig() Conf {
@@ -34,9 +92,132 @@ func LoadConfig() Conf {
 		log.Fatalf("Failed to parse config: %v", err)
 	}
 
+	if err := conf.setupBridges(); err != nil {
+		log.Fatalf("Invalid bridge config: %v", err)
+	}
+
 	return conf
 }
 
+// setupBridges falls back to the single Bridge and names every bridge after its TUN by default
+func (c *Conf) setupBridges() error {
+	if len(c.Bridges) == 0 {
+		if c.Bridge == nil {
+			slog.Warn("No bridge in config, using the defaults", "from", "en0", "to", "utun128")
+			c.Bridges = []Config{defaultBridge()}
+		} else {
+			c.Bridges = []Config{*c.Bridge}
+		}
+	}
+
+	names := make(map[string]bool, len(c.Bridges))
+	for i := range c.Bridges {
+		b := &c.Bridges[i]
+		if b.Name == "" {
+			b.Name = b.ToInterface.Name
+		}
+		if names[b.Name] {
+			return fmt.Errorf("duplicate bridge name %q", b.Name)
+		}
+		names[b.Name] = true
+	}
+	return c.setupStateFiles()
+}
+
+// setupStateFiles gives every bridge of several its own DHCP lease file unless one is set,
+// and refuses state files used twice. Each bridge rewrites its files with only its own state.
+func (c *Conf) setupStateFiles() error {
+	users := make(map[string]string)
+	for i := range c.Bridges {
+		b := &c.Bridges[i]
+		if len(c.Bridges) > 1 && b.DHCP.LeaseFile == "" {
+			b.DHCP.LeaseFile = bridgeFile(defaultDHCPLeaseFile, b.Name)
+		}
+
+		files := []string{b.Neighbors.File, b.ACL.File}
+		if b.DHCP.Enabled {
+			files = append(files, cmp.Or(b.DHCP.LeaseFile, defaultDHCPLeaseFile))
+		}
+		for _, file := range files {
+			if file == "" {
+				continue
+			}
+			key := filepath.Clean(file)
+			if other, ok := users[key]; ok {
+				return fmt.Errorf("state file %s is used by bridge %q and %q", file, other, b.Name)
+			}
+			users[key] = b.Name
+		}
+	}
+	return nil
+}
+
+// bridgeFile inserts the bridge name before the extension of file, dhcp-leases-guest.json
+func bridgeFile(file, name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, name)
+
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "-" + name + ext
+}
+
+// bridgeConfig returns the config of the bridge called name, the first one for an empty name
+func (c *Conf) bridgeConfig(name string) *Config {
+	for i := range c.Bridges {
+		if name == "" || c.Bridges[i].Name == name {
+			return &c.Bridges[i]
+		}
+	}
+	return nil
+}
+
+// onBridgedLAN reports whether ip is in the L2 network of a bridge
+func (c *Conf) onBridgedLAN(ip netip.Addr) bool {
+	for _, b := range c.Bridges {
+		for _, network := range []string{b.FromInterface.Network, b.FromInterface.Network6} {
+			if prefix, err := netip.ParsePrefix(network); err == nil && prefix.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkInbounds warns about bridges whose TUN is not the interface of a sing-box tun inbound
+func (c *Conf) checkInbounds() {
+	data, err := os.ReadFile(c.Sing.FileConfig)
+	if err != nil {
+		slog.Warn("Can't read sing-box config", "err", err)
+		return
+	}
+
+	var main MainConfig
+	if err := json.Unmarshal(data, &main); err != nil {
+		slog.Warn("Can't parse sing-box config", "err", err)
+		return
+	}
+
+	tuns := make(map[string]string)
+	for _, in := range main.Inbounds {
+		if in.Type == "tun" {
+			tuns[in.InterfaceName] = in.Tag
+		}
+	}
+
+	for _, b := range c.Bridges {
+		tag, ok := tuns[b.ToInterface.Name]
+		if !ok {
+			slog.Warn("No sing-box tun inbound for bridge", "bridge", b.Name, "interface", b.ToInterface.Name)
+			continue
+		}
+		slog.Info("Bridge mapped to sing-box inbound", "bridge", b.Name, "interface", b.ToInterface.Name, "inbound", tag)
+	}
+}
+
 type MainConfig struct {
 	Inbounds []struct {
 		Type                   string `json:"type"`
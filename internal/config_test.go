@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetupBridgesDefault(t *testing.T) {
+	var c Conf
+	if err := c.setupBridges(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Bridges) != 1 || c.Bridges[0].Name != "utun128" || c.Bridges[0].FromInterface.Name != "en0" {
+		t.Fatalf("default bridge %+v", c.Bridges)
+	}
+	if _, err := parseAddressing(c.Bridges[0].FromInterface); err != nil {
+		t.Fatalf("default addressing: %v", err)
+	}
+}
+
+func TestSetupBridgesStateFiles(t *testing.T) {
+	bridge := func(name string) Config {
+		cfg := testConfig()
+		cfg.Name = name
+		cfg.DHCP.Enabled = true
+		return cfg
+	}
+
+	c := Conf{Bridges: []Config{bridge("trusted"), bridge("guest")}}
+	if err := c.setupBridges(); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Bridges[1].DHCP.LeaseFile; got != "dhcp-leases-guest.json" {
+		t.Fatalf("lease file %q", got)
+	}
+
+	c = Conf{Bridges: []Config{bridge("trusted"), bridge("guest")}}
+	c.Bridges[0].ACL.File = "acl.json"
+	c.Bridges[1].ACL.File = "./acl.json"
+	if err := c.setupBridges(); err == nil || !strings.Contains(err.Error(), "acl.json") {
+		t.Fatalf("shared acl file accepted: %v", err)
+	}
+}
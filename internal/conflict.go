@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/DaniilSokolyuk/sing-vnet/arpr"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// RFC 5227 section 1.1 timing
+const (
+	probeWait        = time.Second
+	probeNum         = 3
+	probeMin         = time.Second
+	probeMax         = 2 * time.Second
+	announceWait     = 2 * time.Second
+	announceInterval = 2 * time.Second
+	maxConflicts     = 10
+	defendInterval   = 10 * time.Second
+)
+
+// conflictHold is how long a conflict seen during operation stays reported
+const conflictHold = time.Minute
+
+// ConflictConfig probes LocalIP before the gateway claims it (RFC 5227)
+type ConflictConfig struct {
+	Enabled bool `json:"enabled"`
+	// AutoSelect takes the next free address of the network when LocalIP is in use
+	AutoSelect bool `json:"auto_select"`
+}
+
+// AddressConflictError reports another host using the gateway address
+type AddressConflictError struct {
+	IP  net.IP
+	MAC net.HardwareAddr
+}
+
+func (e *AddressConflictError) Error() string {
+	return fmt.Sprintf("address %s is already used by %s", e.IP, e.MAC)
+}
+
+// conflictState tracks conflicts for the claimed address
+type conflictState struct {
+	mu         sync.Mutex
+	err        *AddressConflictError
+	seenAt     time.Time
+	defendedAt time.Time
+}
+
+// claimAddress probes localIP and, with AutoSelect, moves on to the next free address
+func (b *Bridge) claimAddress(ctx context.Context, cfg ConflictConfig) error {
+	for range maxConflicts {
+		mac, err := b.probeAddress(ctx, b.localIP)
+		if err != nil {
+			return err
+		}
+		if mac == nil {
+			return nil
+		}
+
+		conflict := &AddressConflictError{IP: b.localIP, MAC: mac}
+		if !cfg.AutoSelect {
+			return conflict
+		}
+
+		next := b.nextFreeAddress(b.localIP)
+		if next == nil {
+			return conflict
+		}
+		slog.Warn("gateway address in use, trying the next one", "ip", b.localIP, "mac", mac.String(), "next", next)
+		b.localIP = next
+	}
+
+	return fmt.Errorf("no free gateway address after %d conflicts", maxConflicts)
+}
+
+// probeAddress sends ARP probes for ip and returns the MAC of a host using it, nil if it is free.
+// It runs before the bridge forwards traffic, so it reads the L2 side itself.
+func (b *Bridge) probeAddress(ctx context.Context, ip net.IP) (net.HardwareAddr, error) {
+	// A probe has an all-zero sender address so it doesn't pollute ARP caches
+	probe, err := arpr.SendRequest(ip, net.IPv4zero, b.localMAC)
+	if err != nil {
+		return nil, err
+	}
+
+	sent := 0
+	next := time.Now().Add(rand.N(probeWait))
+	for {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if now := time.Now(); !now.Before(next) {
+			if sent == probeNum {
+				return nil, nil
+			}
+			if err := b.from.Write(probe); err != nil {
+				return nil, fmt.Errorf("send arp probe error: %w", err)
+			}
+			sent++
+			next = now.Add(probeMin + rand.N(probeMax-probeMin))
+			if sent == probeNum {
+				next = now.Add(announceWait)
+			}
+		}
+
+		frame := b.from.Read()
+		if frame == nil {
+			continue
+		}
+		mac := b.probeConflict(frame, ip)
+		b.from.Release()
+		if mac != nil {
+			return mac, nil
+		}
+	}
+}
+
+// ownMAC reports whether mac is the gateway's or the host NIC's. With gateway_mac "auto"
+// the host kernel still answers ARP for the gateway IP from the NIC MAC, and pcap captures
+// our own frames, neither is a conflict.
+func (b *Bridge) ownMAC(mac net.HardwareAddr) bool {
+	return bytes.Equal(mac, b.localMAC) || bytes.Equal(mac, b.hostMAC)
+}
+
+// probeConflict returns the sender of an ARP frame that claims ip or probes for it too
+func (b *Bridge) probeConflict(frame []byte, ip net.IP) net.HardwareAddr {
+	if len(frame) < header.EthernetMinimumSize+header.ARPSize ||
+		header.Ethernet(frame).Type() != header.ARPProtocolNumber {
+		return nil
+	}
+
+	arp := header.ARP(frame[header.EthernetMinimumSize:])
+	if !arp.IsValid() || b.ownMAC(arp.HardwareAddressSender()) {
+		return nil
+	}
+
+	sender := net.IP(arp.ProtocolAddressSender())
+	simultaneous := arp.Op() == header.ARPRequest && sender.Equal(net.IPv4zero) &&
+		net.IP(arp.ProtocolAddressTarget()).Equal(ip)
+	if !sender.Equal(ip) && !simultaneous {
+		return nil
+	}
+
+	return bytes.Clone(arp.HardwareAddressSender())
+}
+
+// nextFreeAddress returns the address after ip in the network that no known neighbor uses
+func (b *Bridge) nextFreeAddress(ip net.IP) net.IP {
+	ones, bits := b.network.Mask.Size()
+	size := uint32(1) << (bits - ones)
+	base := binary.BigEndian.Uint32(b.network.IP.To4())
+	offset := binary.BigEndian.Uint32(ip.To4()) - base
+
+	for i := uint32(1); i < size; i++ {
+		n := (offset + i) % size
+		// Skip the network and broadcast addresses
+		if n == 0 || n == size-1 {
+			continue
+		}
+
+		candidate := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(candidate, base+n)
+		if _, ok := b.GetMAC(neighborKey(candidate)); !ok {
+			return candidate
+		}
+	}
+
+	return nil
+}
+
+// addressConflict handles another host sending ARP from the gateway address.
+// The address is defended at most once per defendInterval (RFC 5227 2.4 (c)).
+func (b *Bridge) addressConflict(mac net.HardwareAddr) {
+	now := time.Now()
+
+	b.conflict.mu.Lock()
+	b.conflict.err = &AddressConflictError{IP: b.localIP, MAC: bytes.Clone(mac)}
+	b.conflict.seenAt = now
+	defend := now.Sub(b.conflict.defendedAt) >= defendInterval
+	if defend {
+		b.conflict.defendedAt = now
+	}
+	b.conflict.mu.Unlock()
+
+	slog.Warn("gateway address conflict", "ip", b.localIP, "mac", mac.String(), "defend", defend)
+	if !defend {
+		return
+	}
+
+	garp, err := arpr.SendGratuitousArp(b.localIP, b.localMAC)
+	if err != nil {
+		slog.Error("send arp announcement error", "err", err)
+		return
+	}
+	b.from.Write(garp)
+}
+
+// Err returns the address conflict seen within the last conflictHold, nil while the bridge is healthy
+func (b *Bridge) Err() error {
+	b.conflict.mu.Lock()
+	defer b.conflict.mu.Unlock()
+
+	if b.conflict.err == nil || time.Since(b.conflict.seenAt) > conflictHold {
+		return nil
+	}
+	return b.conflict.err
+}
+
+// LocalIP returns the gateway address, which differs from the config after AutoSelect
+func (b *Bridge) LocalIP() net.IP {
+	return b.localIP
+}
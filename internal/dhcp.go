@@ -0,0 +1,501 @@
+package internal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	defaultDHCPLeaseTime = 12 * time.Hour
+	defaultDHCPLeaseFile = "dhcp-leases.json"
+	// dhcpOfferTime is how long an offered address is held for the client to request it
+	dhcpOfferTime = time.Minute
+	// dhcpDeclineTime keeps addresses a client reported as in use out of the pool
+	dhcpDeclineTime   = 10 * time.Minute
+	dhcpFlagBroadcast = 0x8000
+)
+
+// DHCPConfig enables a DHCPv4 server for the bridged LAN on the gateway IP
+type DHCPConfig struct {
+	Enabled   bool     `json:"enabled"`
+	LeaseTime Duration `json:"lease_time"`
+	// DNS defaults to the gateway IP
+	DNS          []string          `json:"dns"`
+	Reservations []DHCPReservation `json:"reservations"`
+	LeaseFile    string            `json:"lease_file"`
+}
+
+type DHCPReservation struct {
+	MAC string `json:"mac"`
+	IP  string `json:"ip"`
+}
+
+// DHCPLease is an address handed to a client
+type DHCPLease struct {
+	MAC      string    `json:"mac"`
+	IP       net.IP    `json:"ip"`
+	Hostname string    `json:"hostname,omitempty"`
+	Expiry   time.Time `json:"expiry"`
+	// offered leases are not yet acknowledged and never persisted
+	offered bool
+}
+
+type dhcpServer struct {
+	network   *net.IPNet
+	serverIP  net.IP
+	dns       []net.IP
+	leaseTime time.Duration
+	file      string
+
+	mu         sync.Mutex
+	reserved   map[string]net.IP     // mac -> ip
+	reservedBy map[netip.Addr]string // ip -> mac
+	leases     map[string]*DHCPLease // mac -> lease
+	leasedBy   map[netip.Addr]string // ip -> mac of the latest lease of it
+	declined   map[netip.Addr]time.Time
+}
+
+func newDHCPServer(cfg DHCPConfig, network *net.IPNet, serverIP net.IP) (*dhcpServer, error) {
+	s := &dhcpServer{
+		network:    network,
+		serverIP:   serverIP,
+		leaseTime:  time.Duration(cfg.LeaseTime),
+		file:       cfg.LeaseFile,
+		reserved:   make(map[string]net.IP),
+		reservedBy: make(map[netip.Addr]string),
+		leases:     make(map[string]*DHCPLease),
+		leasedBy:   make(map[netip.Addr]string),
+		declined:   make(map[netip.Addr]time.Time),
+	}
+	if s.leaseTime == 0 {
+		s.leaseTime = defaultDHCPLeaseTime
+	}
+	if s.file == "" {
+		s.file = defaultDHCPLeaseFile
+	}
+
+	for _, d := range cfg.DNS {
+		ip := net.ParseIP(d).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid dns address: %s", d)
+		}
+		s.dns = append(s.dns, ip)
+	}
+	if len(s.dns) == 0 {
+		s.dns = []net.IP{serverIP}
+	}
+
+	for _, r := range cfg.Reservations {
+		mac, err := net.ParseMAC(r.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reservation mac: %w", err)
+		}
+		ip := net.ParseIP(r.IP).To4()
+		if ip == nil || !network.Contains(ip) || ip.Equal(serverIP) {
+			return nil, fmt.Errorf("invalid reservation ip: %s", r.IP)
+		}
+		s.reserved[mac.String()] = ip
+		s.reservedBy[neighborKey(ip)] = mac.String()
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Leases returns the active leases
+func (s *dhcpServer) Leases() []DHCPLease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	leases := make([]DHCPLease, 0, len(s.leases))
+	for _, l := range s.leases {
+		if !l.offered && l.Expiry.After(now) {
+			leases = append(leases, *l)
+		}
+	}
+	return leases
+}
+
+// handle processes a client message and returns the reply to send, nil if there is none
+func (s *dhcpServer) handle(req *layers.DHCPv4) (*layers.DHCPv4, *DHCPLease) {
+	if req.Operation != layers.DHCPOpRequest || len(req.ClientHWAddr) != 6 {
+		return nil, nil
+	}
+
+	msgType, ok := dhcpOption(req, layers.DHCPOptMessageType)
+	if !ok || len(msgType) != 1 {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mac := req.ClientHWAddr.String()
+	switch layers.DHCPMsgType(msgType[0]) {
+	case layers.DHCPMsgTypeDiscover:
+		requested, _ := dhcpOption(req, layers.DHCPOptRequestIP)
+		ip := s.allocate(mac, net.IP(requested))
+		if ip == nil {
+			// Offers nobody requested hold their addresses until the next aging tick
+			s.expireOffersLocked(time.Now())
+			ip = s.allocate(mac, net.IP(requested))
+		}
+		if ip == nil {
+			slog.Warn("dhcp pool exhausted", "mac", mac)
+			return nil, nil
+		}
+
+		lease := s.leases[mac]
+		if lease == nil || !lease.IP.Equal(ip) {
+			lease = &DHCPLease{MAC: mac, IP: ip, offered: true}
+			s.setLease(lease)
+		}
+		if lease.offered {
+			lease.Expiry = time.Now().Add(dhcpOfferTime)
+		}
+		return s.reply(req, layers.DHCPMsgTypeOffer, ip), nil
+	case layers.DHCPMsgTypeRequest:
+		// A server identifier for someone else means the client picked another server
+		if id, ok := dhcpOption(req, layers.DHCPOptServerID); ok && !net.IP(id).Equal(s.serverIP) {
+			if lease := s.leases[mac]; lease != nil && lease.offered {
+				s.deleteLease(mac)
+			}
+			return nil, nil
+		}
+
+		requested, ok := dhcpOption(req, layers.DHCPOptRequestIP)
+		ip := net.IP(requested).To4()
+		if !ok {
+			ip = req.ClientIP.To4()
+		}
+
+		if ip == nil || !ip.Equal(s.allocate(mac, ip)) {
+			return s.reply(req, layers.DHCPMsgTypeNak, nil), nil
+		}
+
+		lease := &DHCPLease{MAC: mac, IP: ip, Expiry: time.Now().Add(s.leaseTime)}
+		if hostname, ok := dhcpOption(req, layers.DHCPOptHostname); ok {
+			lease.Hostname = string(hostname)
+		}
+		s.setLease(lease)
+		s.save()
+
+		return s.reply(req, layers.DHCPMsgTypeAck, ip), lease
+	case layers.DHCPMsgTypeRelease:
+		if lease := s.leases[mac]; lease != nil && lease.IP.Equal(req.ClientIP) {
+			s.deleteLease(mac)
+			s.save()
+		}
+	case layers.DHCPMsgTypeDecline:
+		if requested, ok := dhcpOption(req, layers.DHCPOptRequestIP); ok {
+			slog.Warn("dhcp address declined", "mac", mac, "ip", net.IP(requested))
+			s.declined[neighborKey(requested)] = time.Now().Add(dhcpDeclineTime)
+			s.deleteLease(mac)
+			s.save()
+		}
+	case layers.DHCPMsgTypeInform:
+		return s.reply(req, layers.DHCPMsgTypeAck, nil), nil
+	}
+
+	return nil, nil
+}
+
+// allocate picks the address for mac: its reservation, its current lease,
+// the requested address or the first free one. It returns nil if none is available.
+func (s *dhcpServer) allocate(mac string, requested net.IP) net.IP {
+	if ip, ok := s.reserved[mac]; ok {
+		return ip
+	}
+
+	if lease, ok := s.leases[mac]; ok && s.available(mac, lease.IP) {
+		return lease.IP
+	}
+
+	if requested = requested.To4(); requested != nil && s.available(mac, requested) {
+		return requested
+	}
+
+	ones, bits := s.network.Mask.Size()
+	size := uint32(1) << (bits - ones)
+	base := binary.BigEndian.Uint32(s.network.IP.To4())
+	// Skip the network and broadcast addresses
+	for i := uint32(1); i+1 < size; i++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, base+i)
+		if s.available(mac, ip) {
+			return ip
+		}
+	}
+
+	return nil
+}
+
+// available reports whether ip can be given to mac
+func (s *dhcpServer) available(mac string, ip net.IP) bool {
+	if !s.network.Contains(ip) || ip.Equal(s.serverIP) || ip.Equal(s.network.IP) || ip.Equal(broadcastAddr(s.network)) {
+		return false
+	}
+
+	now := time.Now()
+	key := neighborKey(ip)
+	if until, ok := s.declined[key]; ok {
+		if until.After(now) {
+			return false
+		}
+		delete(s.declined, key)
+	}
+
+	if other, ok := s.reservedBy[key]; ok && other != mac {
+		return false
+	}
+
+	if other, ok := s.leasedBy[key]; ok && other != mac && s.leases[other].Expiry.After(now) {
+		return false
+	}
+
+	return true
+}
+
+// setLease makes lease the one of its MAC, called with mu held
+func (s *dhcpServer) setLease(lease *DHCPLease) {
+	s.deleteLease(lease.MAC)
+	s.leases[lease.MAC] = lease
+	s.leasedBy[neighborKey(lease.IP)] = lease.MAC
+}
+
+// deleteLease drops the lease of mac, called with mu held
+func (s *dhcpServer) deleteLease(mac string) {
+	lease, ok := s.leases[mac]
+	if !ok {
+		return
+	}
+	delete(s.leases, mac)
+	// An expired lease may have lost its address to another client since
+	if key := neighborKey(lease.IP); s.leasedBy[key] == mac {
+		delete(s.leasedBy, key)
+	}
+}
+
+// expireOffers forgets the offers the clients didn't request in time, so DISCOVERs from
+// ever new MACs don't pile up
+func (s *dhcpServer) expireOffers(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireOffersLocked(now)
+}
+
+func (s *dhcpServer) expireOffersLocked(now time.Time) {
+	for mac, lease := range s.leases {
+		if lease.offered && !lease.Expiry.After(now) {
+			s.deleteLease(mac)
+		}
+	}
+}
+
+func (s *dhcpServer) reply(req *layers.DHCPv4, msgType layers.DHCPMsgType, ip net.IP) *layers.DHCPv4 {
+	resp := &layers.DHCPv4{
+		Operation:    layers.DHCPOpReply,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          req.Xid,
+		Flags:        req.Flags,
+		ClientIP:     net.IPv4zero,
+		YourClientIP: net.IPv4zero,
+		NextServerIP: net.IPv4zero,
+		RelayAgentIP: req.RelayAgentIP,
+		ClientHWAddr: req.ClientHWAddr,
+	}
+
+	resp.Options = append(resp.Options,
+		layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)}),
+		layers.NewDHCPOption(layers.DHCPOptServerID, s.serverIP.To4()),
+	)
+
+	if msgType == layers.DHCPMsgTypeNak {
+		return resp
+	}
+
+	if ip != nil {
+		resp.YourClientIP = ip
+		resp.Options = append(resp.Options,
+			layers.NewDHCPOption(layers.DHCPOptLeaseTime, dhcpSeconds(s.leaseTime)),
+			layers.NewDHCPOption(layers.DHCPOptT1, dhcpSeconds(s.leaseTime/2)),
+			layers.NewDHCPOption(layers.DHCPOptT2, dhcpSeconds(s.leaseTime*7/8)),
+		)
+	} else {
+		resp.ClientIP = req.ClientIP
+	}
+
+	dns := make([]byte, 0, len(s.dns)*net.IPv4len)
+	for _, d := range s.dns {
+		dns = append(dns, d...)
+	}
+
+	resp.Options = append(resp.Options,
+		layers.NewDHCPOption(layers.DHCPOptSubnetMask, s.network.Mask),
+		layers.NewDHCPOption(layers.DHCPOptRouter, s.serverIP.To4()),
+		layers.NewDHCPOption(layers.DHCPOptDNS, dns),
+	)
+
+	return resp
+}
+
+func (s *dhcpServer) load() error {
+	data, err := os.ReadFile(s.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read dhcp leases error: %w", err)
+	}
+
+	var leases []*DHCPLease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return fmt.Errorf("parse dhcp leases error: %w", err)
+	}
+
+	now := time.Now()
+	for _, l := range leases {
+		if l.Expiry.After(now) && s.network.Contains(l.IP) {
+			s.setLease(l)
+		}
+	}
+
+	return nil
+}
+
+// save writes the acknowledged leases, called with mu held
+func (s *dhcpServer) save() {
+	leases := make([]*DHCPLease, 0, len(s.leases))
+	for _, l := range s.leases {
+		if !l.offered {
+			leases = append(leases, l)
+		}
+	}
+
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		slog.Error("marshal dhcp leases error", "err", err)
+		return
+	}
+
+	if err := os.WriteFile(s.file, data, 0644); err != nil {
+		slog.Error("write dhcp leases error", "err", err)
+	}
+}
+
+func broadcastAddr(network *net.IPNet) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	for i, b := range network.IP.To4() {
+		ip[i] = b | ^network.Mask[len(network.Mask)-net.IPv4len+i]
+	}
+	return ip
+}
+
+func dhcpOption(p *layers.DHCPv4, typ layers.DHCPOpt) ([]byte, bool) {
+	for _, o := range p.Options {
+		if o.Type == typ {
+			return o.Data, true
+		}
+	}
+	return nil, false
+}
+
+func dhcpSeconds(d time.Duration) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(d/time.Second))
+}
+
+// isDHCPRequest reports whether ip carries a message to a DHCP server
+func isDHCPRequest(ip header.IPv4) bool {
+	if ip.TransportProtocol() != header.UDPProtocolNumber || !ip.IsValid(len(ip)) {
+		return false
+	}
+
+	udp := header.UDP(ip.Payload())
+	return len(udp) >= header.UDPMinimumSize && udp.DestinationPort() == dhcpServerPort
+}
+
+// handleDHCP answers a DHCP message from the LAN and learns the client on acknowledgement
+func (b *Bridge) handleDHCP(packet []byte) {
+	gPckt := gopacket.NewPacket(packet, layers.LayerTypeEthernet, gopacket.Default)
+	req, ok := gPckt.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+	if !ok {
+		return
+	}
+
+	resp, lease := b.dhcp.handle(req)
+	if resp == nil {
+		return
+	}
+
+	if lease != nil {
+		b.StoreMAC(neighborKey(lease.IP), req.ClientHWAddr)
+		slog.Info("dhcp lease", "ip", lease.IP, "mac", lease.MAC, "hostname", lease.Hostname)
+	}
+
+	// RFC 2131 4.1: NAKs are broadcast, renewing clients get unicast,
+	// others get broadcast only if they asked for it
+	dstMAC, dstIP := req.ClientHWAddr, resp.YourClientIP
+	switch {
+	case resp.YourClientIP.IsUnspecified() && resp.ClientIP.IsUnspecified():
+		dstMAC, dstIP = layers.EthernetBroadcast, net.IPv4bcast
+	case !req.ClientIP.IsUnspecified():
+		dstIP = req.ClientIP
+	case req.Flags&dhcpFlagBroadcast != 0:
+		dstMAC, dstIP = layers.EthernetBroadcast, net.IPv4bcast
+	}
+
+	eth := &layers.Ethernet{
+		SrcMAC:       b.localMAC,
+		DstMAC:       dstMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    b.localIP,
+		DstIP:    dstIP,
+	}
+	udp := &layers.UDP{
+		SrcPort: dhcpServerPort,
+		DstPort: dhcpClientPort,
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		slog.Error("dhcp checksum error", "err", err)
+		return
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	if err := gopacket.SerializeLayers(buffer, opts, eth, ip, udp, resp); err != nil {
+		slog.Error("failed to serialize dhcp reply", "err", err)
+		return
+	}
+
+	if err := b.from.Write(buffer.Bytes()); err != nil {
+		slog.Error("send dhcp reply error", "err", err)
+	}
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+func newTestDHCPServer(tb testing.TB, cfg DHCPConfig) *dhcpServer {
+	tb.Helper()
+
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	cfg.LeaseFile = filepath.Join(tb.TempDir(), "leases.json")
+	s, err := newDHCPServer(cfg, network, testGatewayIP)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return s
+}
+
+func dhcpMessage(mac net.HardwareAddr, msgType layers.DHCPMsgType, opts ...layers.DHCPOption) *layers.DHCPv4 {
+	return &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		ClientHWAddr: mac,
+		ClientIP:     net.IPv4zero,
+		Options:      append([]layers.DHCPOption{layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)})}, opts...),
+	}
+}
+
+func TestDHCPOffersExpire(t *testing.T) {
+	s := newTestDHCPServer(t, DHCPConfig{})
+
+	// More clients than the pool has addresses discover and never request
+	for i := range 1000 {
+		mac := net.HardwareAddr{0x06, 0, 0, 0, byte(i >> 8), byte(i)}
+		s.handle(dhcpMessage(mac, layers.DHCPMsgTypeDiscover))
+	}
+	if n := len(s.leases); n > 253 {
+		t.Fatalf("%d offers held for a pool of 253", n)
+	}
+
+	s.expireOffers(time.Now().Add(dhcpOfferTime + time.Second))
+	if len(s.leases) != 0 || len(s.leasedBy) != 0 {
+		t.Fatalf("%d offers and %d addresses left after they expired", len(s.leases), len(s.leasedBy))
+	}
+
+	// The pool is free again
+	resp, _ := s.handle(dhcpMessage(testClientMAC, layers.DHCPMsgTypeDiscover))
+	if resp == nil || !resp.YourClientIP.Equal(testClientIP) {
+		t.Fatalf("offer %v after the pool drained", resp)
+	}
+}
+
+func TestDHCPAddressTaken(t *testing.T) {
+	s := newTestDHCPServer(t, DHCPConfig{
+		Reservations: []DHCPReservation{{MAC: testPeerMAC.String(), IP: "10.0.0.2"}},
+	})
+
+	// The reserved address is skipped, the requested one goes to the first client asking
+	resp, _ := s.handle(dhcpMessage(testClientMAC, layers.DHCPMsgTypeDiscover))
+	if resp == nil || !resp.YourClientIP.Equal(testPeerIP) {
+		t.Fatalf("offer %v, want %s", resp, testPeerIP)
+	}
+	requestIP := layers.NewDHCPOption(layers.DHCPOptRequestIP, testPeerIP)
+	if _, lease := s.handle(dhcpMessage(testClientMAC, layers.DHCPMsgTypeRequest, requestIP)); lease == nil {
+		t.Fatal("request not acknowledged")
+	}
+
+	other := net.HardwareAddr{0x06, 0, 0, 0, 0, 0x04}
+	resp, _ = s.handle(dhcpMessage(other, layers.DHCPMsgTypeRequest, requestIP))
+	if typ, _ := dhcpOption(resp, layers.DHCPOptMessageType); len(typ) != 1 || layers.DHCPMsgType(typ[0]) != layers.DHCPMsgTypeNak {
+		t.Fatal("leased address given to another client")
+	}
+
+	resp, _ = s.handle(dhcpMessage(testPeerMAC, layers.DHCPMsgTypeDiscover))
+	if resp == nil || !resp.YourClientIP.Equal(testClientIP) {
+		t.Fatalf("reservation offered %v, want %s", resp, testClientIP)
+	}
+}
@@ -0,0 +1,288 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	dnsPort          = 53
+	defaultDNSDomain = "vnet"
+	dnsLocalTTL      = 60
+	dnsUpstreamWait  = 5 * time.Second
+	// dnsUpstreamMax bounds the queries waiting for the upstream resolver at once
+	dnsUpstreamMax = 64
+)
+
+// DNSConfig answers DNS queries sent to the gateway IP inside sing-vnet
+type DNSConfig struct {
+	Enabled bool `json:"enabled"`
+	// Upstream is a host:port resolver, empty passes other queries into the TUN for sing-box
+	Upstream string `json:"upstream"`
+	// Domain is the zone LAN clients are resolved in, e.g. ps5.vnet
+	Domain string `json:"domain"`
+	// Hosts are static names in the zone
+	Hosts map[string]string `json:"hosts"`
+}
+
+type dnsResponder struct {
+	upstream string
+	domain   string
+	hosts    map[string][]net.IP
+	// inflight holds a token per query sent upstream
+	inflight chan struct{}
+}
+
+func newDNSResponder(cfg DNSConfig) (*dnsResponder, error) {
+	d := &dnsResponder{
+		upstream: cfg.Upstream,
+		domain:   strings.ToLower(strings.Trim(cfg.Domain, ".")),
+		hosts:    make(map[string][]net.IP),
+		inflight: make(chan struct{}, dnsUpstreamMax),
+	}
+	if d.domain == "" {
+		d.domain = defaultDNSDomain
+	}
+
+	if d.upstream != "" {
+		if _, _, err := net.SplitHostPort(d.upstream); err != nil {
+			d.upstream = net.JoinHostPort(d.upstream, "53")
+		}
+	}
+
+	for name, addr := range cfg.Hosts {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address for host %s: %s", name, addr)
+		}
+		name = strings.ToLower(strings.Trim(name, "."))
+		d.hosts[name] = append(d.hosts[name], ip)
+	}
+
+	return d, nil
+}
+
+// isGatewayDNS reports whether the IP packet is a DNS query to a gateway address
+func (b *Bridge) isGatewayDNS(proto tcpip.NetworkProtocolNumber, packet []byte) bool {
+	transport, payload, ok := b.gatewayPayload(proto, packet)
+	return ok && transport == header.UDPProtocolNumber &&
+		len(payload) >= header.UDPMinimumSize && header.UDP(payload).DestinationPort() == dnsPort
+}
+
+// handleDNS answers a query sent to the gateway. It reports false when the query
+// should go on into the TUN for sing-box to resolve.
+func (b *Bridge) handleDNS(ctx context.Context, packet []byte) bool {
+	gPckt := gopacket.NewPacket(packet, layers.LayerTypeEthernet, gopacket.Default)
+	query, ok := gPckt.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	if !ok || query.QR || len(query.Questions) != 1 {
+		return false
+	}
+
+	q := query.Questions[0]
+	name := strings.ToLower(strings.TrimSuffix(string(q.Name), "."))
+	if name == b.dns.domain || strings.HasSuffix(name, "."+b.dns.domain) {
+		b.writeDNSReply(gPckt, b.answerLocal(query, strings.TrimSuffix(name, "."+b.dns.domain)))
+		return true
+	}
+
+	if b.dns.upstream == "" {
+		return false
+	}
+
+	udp, ok := gPckt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		return false
+	}
+
+	// A client flooding queries loses them instead of costing a goroutine and a buffer each
+	select {
+	case b.dns.inflight <- struct{}{}:
+	default:
+		slog.Debug("dns upstream busy, query dropped", "name", name)
+		return true
+	}
+
+	payload := append([]byte(nil), udp.Payload...)
+	b.goBackground(func() {
+		defer func() { <-b.dns.inflight }()
+		resp, err := b.dns.exchange(ctx, payload)
+		if err != nil {
+			slog.Debug("dns upstream error", "name", name, "err", err)
+			return
+		}
+		b.writeDNSReply(gPckt, gopacket.Payload(resp))
+	})
+
+	return true
+}
+
+// answerLocal resolves host in the bridge zone from static hosts, DHCP leases and learned neighbors
+func (b *Bridge) answerLocal(query *layers.DNS, host string) *layers.DNS {
+	resp := &layers.DNS{
+		ID:           query.ID,
+		QR:           true,
+		OpCode:       query.OpCode,
+		AA:           true,
+		RD:           query.RD,
+		RA:           true,
+		ResponseCode: layers.DNSResponseCodeNoErr,
+		Questions:    query.Questions,
+	}
+
+	ips, ok := b.lookupHost(host)
+	if !ok {
+		resp.ResponseCode = layers.DNSResponseCodeNXDomain
+		return resp
+	}
+
+	q := query.Questions[0]
+	for _, ip := range ips {
+		rr := layers.DNSResourceRecord{
+			Name:  q.Name,
+			Class: layers.DNSClassIN,
+			TTL:   dnsLocalTTL,
+			IP:    ip,
+		}
+		switch {
+		case q.Type == layers.DNSTypeA && ip.To4() != nil:
+			rr.Type = layers.DNSTypeA
+		case q.Type == layers.DNSTypeAAAA && ip.To4() == nil:
+			rr.Type = layers.DNSTypeAAAA
+		default:
+			continue
+		}
+		resp.Answers = append(resp.Answers, rr)
+	}
+
+	return resp
+}
+
+// lookupHost returns the addresses of a LAN client or static host
+func (b *Bridge) lookupHost(host string) ([]net.IP, bool) {
+	if ips, ok := b.dns.hosts[host]; ok {
+		return ips, true
+	}
+
+	if b.dhcp == nil {
+		return nil, false
+	}
+
+	for _, lease := range b.dhcp.Leases() {
+		if !strings.EqualFold(lease.Hostname, host) {
+			continue
+		}
+
+		ips := []net.IP{lease.IP}
+		// IPv6 addresses of the same device come from the neighbor table
+		b.mapMux.RLock()
+		for ip, e := range b.neighbors {
+			if e.state != neighborIncomplete && e.mac.String() == lease.MAC && ip.Is6() {
+				ips = append(ips, e.ip)
+			}
+		}
+		b.mapMux.RUnlock()
+		return ips, true
+	}
+
+	return nil, false
+}
+
+// exchange sends a raw query to the upstream resolver and returns its raw answer
+func (d *dnsResponder) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsUpstreamWait)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", d.upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	// Closing the connection unblocks the read when the bridge stops
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// writeDNSReply sends payload back to the client that sent the query packet
+func (b *Bridge) writeDNSReply(query gopacket.Packet, payload gopacket.SerializableLayer) {
+	eth, _ := query.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	udp, _ := query.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if eth == nil || udp == nil {
+		return
+	}
+
+	replyEth := &layers.Ethernet{
+		SrcMAC:       b.localMAC,
+		DstMAC:       eth.SrcMAC,
+		EthernetType: eth.EthernetType,
+	}
+	replyUDP := &layers.UDP{
+		SrcPort: udp.DstPort,
+		DstPort: udp.SrcPort,
+	}
+
+	var replyIP gopacket.NetworkLayer
+	switch ip := query.NetworkLayer().(type) {
+	case *layers.IPv4:
+		replyIP = &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    ip.DstIP,
+			DstIP:    ip.SrcIP,
+		}
+	case *layers.IPv6:
+		replyIP = &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      ip.DstIP,
+			DstIP:      ip.SrcIP,
+		}
+	default:
+		return
+	}
+
+	if err := replyUDP.SetNetworkLayerForChecksum(replyIP); err != nil {
+		slog.Error("dns checksum error", "err", err)
+		return
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	err := gopacket.SerializeLayers(buffer, opts, replyEth, replyIP.(gopacket.SerializableLayer), replyUDP, payload)
+	if err != nil {
+		slog.Error("failed to serialize dns reply", "err", err)
+		return
+	}
+
+	if err := b.from.Write(buffer.Bytes()); err != nil {
+		slog.Error("send dns reply error", "err", err)
+	}
+}
@@ -0,0 +1,265 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const defaultPingInterval = 10 * time.Second
+
+// PingConfig measures the RTT from the gateway to every LAN client, shown with the neighbors
+type PingConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Interval Duration `json:"interval"`
+}
+
+// isGatewayEcho reports whether the IP packet is an ICMP echo request or reply for the gateway
+func (b *Bridge) isGatewayEcho(proto tcpip.NetworkProtocolNumber, packet []byte) bool {
+	transport, payload, ok := b.gatewayPayload(proto, packet)
+	if !ok {
+		return false
+	}
+
+	switch transport {
+	case header.ICMPv4ProtocolNumber:
+		if len(payload) < header.ICMPv4MinimumSize {
+			return false
+		}
+		typ := header.ICMPv4(payload).Type()
+		return typ == header.ICMPv4Echo || typ == header.ICMPv4EchoReply
+	case header.ICMPv6ProtocolNumber:
+		if len(payload) < header.ICMPv6MinimumSize {
+			return false
+		}
+		typ := header.ICMPv6(payload).Type()
+		return typ == header.ICMPv6EchoRequest || typ == header.ICMPv6EchoReply
+	default:
+		return false
+	}
+}
+
+// handleEcho answers an echo request to the gateway, or records the RTT of a reply to our own ping
+func (b *Bridge) handleEcho(packet []byte) {
+	gPckt := gopacket.NewPacket(packet, layers.LayerTypeEthernet, gopacket.Default)
+	eth, _ := gPckt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if eth == nil {
+		return
+	}
+
+	var src netip.Addr
+	var id, seq uint16
+	var data, replyData []byte
+	var reply bool
+	var replyIP, replyICMP gopacket.SerializableLayer
+
+	switch ip := gPckt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		icmp, ok := gPckt.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+		if !ok {
+			return
+		}
+		src, id, seq, data = neighborKey(ip.SrcIP), icmp.Id, icmp.Seq, icmp.Payload
+		reply = icmp.TypeCode.Type() == layers.ICMPv4TypeEchoReply
+		replyData = data
+
+		replyIP = &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    ip.DstIP,
+			DstIP:    ip.SrcIP,
+		}
+		replyICMP = &layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0),
+			Id:       id,
+			Seq:      seq,
+		}
+	case *layers.IPv6:
+		icmp, ok := gPckt.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+		if !ok {
+			return
+		}
+		echo, ok := gPckt.Layer(layers.LayerTypeICMPv6Echo).(*layers.ICMPv6Echo)
+		if !ok {
+			return
+		}
+		src, id, seq, data = neighborKey(ip.SrcIP), echo.Identifier, echo.SeqNumber, echo.Payload
+		reply = icmp.TypeCode.Type() == layers.ICMPv6TypeEchoReply
+
+		ip6 := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolICMPv6,
+			SrcIP:      ip.DstIP,
+			DstIP:      ip.SrcIP,
+		}
+		icmp6 := &layers.ICMPv6{
+			TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoReply, 0),
+		}
+		if err := icmp6.SetNetworkLayerForChecksum(ip6); err != nil {
+			return
+		}
+		replyIP, replyICMP = ip6, icmp6
+		// The ICMPv6 layer only writes type, code and checksum
+		replyData = append(binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, id), seq), data...)
+	default:
+		return
+	}
+
+	if reply {
+		b.recordPing(src, id, data)
+		return
+	}
+
+	replyEth := &layers.Ethernet{
+		SrcMAC:       b.localMAC,
+		DstMAC:       eth.SrcMAC,
+		EthernetType: eth.EthernetType,
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	err := gopacket.SerializeLayers(buffer, opts, replyEth, replyIP, replyICMP, gopacket.Payload(replyData))
+	if err != nil {
+		slog.Error("failed to serialize echo reply", "err", err)
+		return
+	}
+
+	if err := b.from.Write(buffer.Bytes()); err != nil {
+		slog.Error("send echo reply error", "err", err)
+	}
+}
+
+// recordPing stores the RTT of a reply to one of our pings, which carry the send time
+func (b *Bridge) recordPing(ip netip.Addr, id uint16, data []byte) {
+	if id != b.pingID || len(data) < 8 {
+		return
+	}
+
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	rtt := time.Since(sent)
+	if rtt < 0 || rtt > time.Duration(b.pingEvery) {
+		return
+	}
+
+	b.mapMux.Lock()
+	if e, ok := b.neighbors[ip]; ok {
+		e.rtt = rtt
+	}
+	b.mapMux.Unlock()
+}
+
+// pingNeighbors pings every resolved neighbor each interval until ctx is done
+func (b *Bridge) pingNeighbors(ctx context.Context) {
+	ticker := time.NewTicker(b.pingEvery)
+	defer ticker.Stop()
+
+	var seq uint16
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		type target struct {
+			ip  net.IP
+			mac net.HardwareAddr
+		}
+		var targets []target
+		b.mapMux.RLock()
+		for _, e := range b.neighbors {
+			if e.state != neighborIncomplete {
+				targets = append(targets, target{e.ip, e.mac})
+			}
+		}
+		b.mapMux.RUnlock()
+
+		seq++
+		for _, t := range targets {
+			b.sendPing(t.ip, t.mac, seq)
+		}
+	}
+}
+
+func (b *Bridge) sendPing(ip net.IP, mac net.HardwareAddr, seq uint16) {
+	data := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+
+	eth := &layers.Ethernet{
+		SrcMAC: b.localMAC,
+		DstMAC: mac,
+	}
+	var netLayer, icmp gopacket.SerializableLayer
+
+	if ip4 := ip.To4(); ip4 != nil {
+		eth.EthernetType = layers.EthernetTypeIPv4
+		netLayer = &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    b.localIP,
+			DstIP:    ip4,
+		}
+		icmp = &layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0),
+			Id:       b.pingID,
+			Seq:      seq,
+		}
+	} else {
+		if b.localIP6 == nil {
+			return
+		}
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip6 := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolICMPv6,
+			SrcIP:      b.localIP6,
+			DstIP:      ip,
+		}
+		icmp6 := &layers.ICMPv6{
+			TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0),
+		}
+		if err := icmp6.SetNetworkLayerForChecksum(ip6); err != nil {
+			return
+		}
+		netLayer, icmp = ip6, icmp6
+		// The ICMPv6 layer only writes type, code and checksum
+		data = append(binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, b.pingID), seq), data...)
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	if err := gopacket.SerializeLayers(buffer, opts, eth, netLayer, icmp, gopacket.Payload(data)); err != nil {
+		slog.Error("failed to serialize ping", "err", err)
+		return
+	}
+
+	if err := b.from.Write(buffer.Bytes()); err != nil {
+		slog.Debug("send ping error", "ip", ip, "err", err)
+	}
+}
+
+func (b *Bridge) setupPing(cfg PingConfig) {
+	b.pingID = uint16(rand.Uint32())
+	b.pingEvery = time.Duration(cfg.Interval)
+	if b.pingEvery <= 0 {
+		b.pingEvery = defaultPingInterval
+	}
+}
@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/gopacket/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// Framing converts between the frames of a link type and bare network packets
+type Framing interface {
+	// HeaderLen is the size of the link header Encode writes
+	HeaderLen() int
+	// Decode returns the network protocol and packet carried by frame
+	Decode(frame []byte) (tcpip.NetworkProtocolNumber, []byte, bool)
+	// Encode writes the link header for a packet of proto into hdr[:HeaderLen()]
+	Encode(hdr []byte, proto tcpip.NetworkProtocolNumber)
+}
+
+// pcap reports DLT values as they are, DLT_RAW is 12 on most systems and 14 on OpenBSD
+const (
+	linkTypeDLTRaw        layers.LinkType = 12
+	linkTypeDLTRawOpenBSD layers.LinkType = 14
+)
+
+// NewFraming returns the codec for linkType. Ethernet frames are addressed from and to mac.
+func NewFraming(linkType layers.LinkType, mac net.HardwareAddr) (Framing, error) {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		if len(mac) != 6 {
+			mac = make(net.HardwareAddr, 6)
+		}
+		return ethernetFraming{mac: mac}, nil
+	case layers.LinkTypeNull:
+		// DLT_NULL carries the address family in host byte order
+		return nullFraming{order: binary.NativeEndian}, nil
+	case layers.LinkTypeLoop:
+		return nullFraming{order: binary.BigEndian}, nil
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6, linkTypeDLTRaw, linkTypeDLTRawOpenBSD:
+		return rawFraming{}, nil
+	case layers.LinkTypeLinuxSLL:
+		return sllFraming{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported link type %s", linkType)
+	}
+}
+
+// framingFor returns the codec a PacketIO exposes, or the one matching its link type
+func framingFor(p PacketIO) (Framing, error) {
+	if f, ok := p.(interface{ Framing() Framing }); ok {
+		return f.Framing(), nil
+	}
+	return NewFraming(p.LinkType(), p.MAC())
+}
+
+type ethernetFraming struct {
+	mac net.HardwareAddr
+}
+
+func (f ethernetFraming) HeaderLen() int { return header.EthernetMinimumSize }
+
+func (f ethernetFraming) Decode(frame []byte) (tcpip.NetworkProtocolNumber, []byte, bool) {
+	if len(frame) < header.EthernetMinimumSize {
+		return 0, nil, false
+	}
+	return header.Ethernet(frame).Type(), frame[header.EthernetMinimumSize:], true
+}
+
+func (f ethernetFraming) Encode(hdr []byte, proto tcpip.NetworkProtocolNumber) {
+	copy(hdr[0:6], f.mac)
+	copy(hdr[6:12], f.mac)
+	binary.BigEndian.PutUint16(hdr[12:14], uint16(proto))
+}
+
+// nullFraming is DLT_NULL and DLT_LOOP: a 4 byte address family, as used by macOS utun
+type nullFraming struct {
+	order binary.ByteOrder
+}
+
+const nullHeaderSize = 4
+
+func (f nullFraming) HeaderLen() int { return nullHeaderSize }
+
+func (f nullFraming) Decode(frame []byte) (tcpip.NetworkProtocolNumber, []byte, bool) {
+	if len(frame) < nullHeaderSize {
+		return 0, nil, false
+	}
+
+	switch f.order.Uint32(frame) {
+	case syscall.AF_INET:
+		return header.IPv4ProtocolNumber, frame[nullHeaderSize:], true
+	// AF_INET6 of Linux, Windows, NetBSD/OpenBSD, FreeBSD and macOS
+	case 10, 23, 24, 28, 30:
+		return header.IPv6ProtocolNumber, frame[nullHeaderSize:], true
+	default:
+		return 0, nil, false
+	}
+}
+
+func (f nullFraming) Encode(hdr []byte, proto tcpip.NetworkProtocolNumber) {
+	family := syscall.AF_INET
+	if proto == header.IPv6ProtocolNumber {
+		family = syscall.AF_INET6
+	}
+	f.order.PutUint32(hdr, uint32(family))
+}
+
+// rawFraming is bare IP, the version nibble tells IPv4 from IPv6
+type rawFraming struct{}
+
+func (rawFraming) HeaderLen() int { return 0 }
+
+func (rawFraming) Decode(frame []byte) (tcpip.NetworkProtocolNumber, []byte, bool) {
+	switch header.IPVersion(frame) {
+	case header.IPv4Version:
+		return header.IPv4ProtocolNumber, frame, true
+	case header.IPv6Version:
+		return header.IPv6ProtocolNumber, frame, true
+	default:
+		return 0, nil, false
+	}
+}
+
+func (rawFraming) Encode([]byte, tcpip.NetworkProtocolNumber) {}
+
+// sllFraming is the Linux cooked capture header
+type sllFraming struct{}
+
+const (
+	sllHeaderSize     = 16
+	sllPacketOutgoing = 4
+	sllARPHRDNone     = 0xfffe
+)
+
+func (sllFraming) HeaderLen() int { return sllHeaderSize }
+
+func (sllFraming) Decode(frame []byte) (tcpip.NetworkProtocolNumber, []byte, bool) {
+	if len(frame) < sllHeaderSize {
+		return 0, nil, false
+	}
+	proto := tcpip.NetworkProtocolNumber(binary.BigEndian.Uint16(frame[14:16]))
+	return proto, frame[sllHeaderSize:], true
+}
+
+func (sllFraming) Encode(hdr []byte, proto tcpip.NetworkProtocolNumber) {
+	clear(hdr[:sllHeaderSize])
+	binary.BigEndian.PutUint16(hdr[0:2], sllPacketOutgoing)
+	binary.BigEndian.PutUint16(hdr[2:4], sllARPHRDNone)
+	binary.BigEndian.PutUint16(hdr[14:16], uint16(proto))
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	// icmpv4QuoteSize is the original datagram data quoted after its IP header (RFC 792)
+	icmpv4QuoteSize = 8
+	// icmpv6ErrorMax keeps ICMPv6 errors within the IPv6 minimum MTU (RFC 4443 2.4)
+	icmpv6ErrorMax = header.IPv6MinimumMTU
+)
+
+// icmpKind is an ICMP error the gateway sends, mapped to its ICMPv4 and ICMPv6 type and code
+type icmpKind int
+
+const (
+	icmpHostUnreachable icmpKind = iota
+	// icmpTooBig is fragmentation needed for IPv4 and packet too big for IPv6
+	icmpTooBig
+	// icmpTimeExceeded reports a TTL or hop limit that ran out at the gateway
+	icmpTimeExceeded
+)
+
+// writeUnreachable tells the sender of packet, on the L3 side, that its destination is unreachable
+func (b *Bridge) writeUnreachable(proto tcpip.NetworkProtocolNumber, packet []byte) {
+	reply, err := b.icmpError(proto, packet, icmpHostUnreachable, 0)
+	if err != nil {
+		slog.Error("build icmp unreachable error", "err", err)
+		return
+	}
+	if reply == nil {
+		return
+	}
+
+	if err := b.writeL3(reply, 0, proto); err != nil {
+		slog.Error("send icmp unreachable error", "err", err)
+	}
+}
+
+// icmpError builds an ICMP error of kind from the gateway quoting packet, mtu is the
+// next-hop MTU of icmpTooBig. It returns nil for packets that must not trigger an ICMP error.
+func (b *Bridge) icmpError(proto tcpip.NetworkProtocolNumber, packet []byte, kind icmpKind, mtu int) ([]byte, error) {
+	var ip gopacket.SerializableLayer
+	var icmp gopacket.SerializableLayer
+	var quote []byte
+
+	switch proto {
+	case header.IPv4ProtocolNumber:
+		orig := header.IPv4(packet)
+		if !orig.IsValid(len(packet)) || orig.FragmentOffset() != 0 {
+			return nil, nil
+		}
+		src := net.IP(orig.SourceAddressSlice())
+		if !src.IsGlobalUnicast() {
+			return nil, nil
+		}
+		if orig.TransportProtocol() == header.ICMPv4ProtocolNumber && isICMPv4Error(orig.Payload()) {
+			return nil, nil
+		}
+
+		ip = &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    b.localIP,
+			DstIP:    src,
+		}
+		icmp4 := &layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeHost),
+		}
+		switch kind {
+		case icmpTooBig:
+			// The next-hop MTU takes the low half of the unused word (RFC 1191)
+			icmp4.TypeCode = layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded)
+			icmp4.Seq = uint16(mtu)
+		case icmpTimeExceeded:
+			icmp4.TypeCode = layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded)
+		}
+		icmp = icmp4
+		quote = packet[:min(len(packet), int(orig.HeaderLength())+icmpv4QuoteSize)]
+	case header.IPv6ProtocolNumber:
+		orig := header.IPv6(packet)
+		if !orig.IsValid(len(packet)) {
+			return nil, nil
+		}
+		src := net.IP(orig.SourceAddressSlice())
+		if src.IsUnspecified() || src.IsMulticast() {
+			return nil, nil
+		}
+		if orig.TransportProtocol() == header.ICMPv6ProtocolNumber && isICMPv6Error(orig.Payload()) {
+			return nil, nil
+		}
+
+		ip6 := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolICMPv6,
+			SrcIP:      b.localIP6,
+			DstIP:      src,
+		}
+		icmp6 := &layers.ICMPv6{
+			TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodeAddressUnreachable),
+		}
+		// The ICMPv6 layer writes only type, code and checksum, the next 4 bytes go with the quote
+		rest := make([]byte, 4)
+		switch kind {
+		case icmpTooBig:
+			icmp6.TypeCode = layers.CreateICMPv6TypeCode(layers.ICMPv6TypePacketTooBig, 0)
+			binary.BigEndian.PutUint32(rest, uint32(mtu))
+		case icmpTimeExceeded:
+			icmp6.TypeCode = layers.CreateICMPv6TypeCode(layers.ICMPv6TypeTimeExceeded, layers.ICMPv6CodeHopLimitExceeded)
+		}
+		if err := icmp6.SetNetworkLayerForChecksum(ip6); err != nil {
+			return nil, err
+		}
+		ip, icmp = ip6, icmp6
+		limit := icmpv6ErrorMax - header.IPv6MinimumSize - header.ICMPv6MinimumSize
+		quote = append(rest, packet[:min(len(packet), limit)]...)
+	default:
+		return nil, nil
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	if err := gopacket.SerializeLayers(buffer, opts, ip, icmp, gopacket.Payload(quote)); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// isICMPv4Error reports whether the ICMP message is an error, which never gets an error in reply
+func isICMPv4Error(payload []byte) bool {
+	if len(payload) < header.ICMPv4MinimumSize {
+		return true
+	}
+
+	switch header.ICMPv4(payload).Type() {
+	case header.ICMPv4DstUnreachable, header.ICMPv4SrcQuench, header.ICMPv4Redirect,
+		header.ICMPv4TimeExceeded, header.ICMPv4ParamProblem:
+		return true
+	default:
+		return false
+	}
+}
+
+// isICMPv6Error reports whether the ICMPv6 message is an error, types below 128 (RFC 4443 2.1)
+func isICMPv6Error(payload []byte) bool {
+	if len(payload) < header.ICMPv6MinimumSize {
+		return true
+	}
+	return header.ICMPv6(payload).Type() < header.ICMPv6EchoRequest
+}
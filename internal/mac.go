@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// gatewayMACAuto derives a stable locally administered MAC from the NIC MAC and the gateway address
+const gatewayMACAuto = "auto"
+
+// gatewayMAC returns the MAC the gateway answers ARP with and sends frames from.
+// An empty cfg keeps the NIC MAC.
+func gatewayMAC(cfg string, nic net.HardwareAddr, ip net.IP) (net.HardwareAddr, error) {
+	switch cfg {
+	case "":
+		return nic, nil
+	case gatewayMACAuto:
+		sum := sha256.Sum256(append(bytes.Clone(nic), ip.To4()...))
+		mac := net.HardwareAddr(sum[:6])
+		// Unicast and locally administered
+		mac[0] = mac[0]&^0x01 | 0x02
+		return mac, nil
+	}
+
+	mac, err := net.ParseMAC(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(mac) != 6 || mac[0]&0x01 != 0 {
+		return nil, fmt.Errorf("%s is not a unicast ethernet address", mac)
+	}
+	if mac[0]&0x02 == 0 {
+		slog.Warn("gateway mac is not locally administered and may clash with a real device", "mac", mac.String())
+	}
+	return mac, nil
+}
+
+// forGateway reports whether an ethernet frame is addressed to mac or to a group the gateway listens to.
+// Promiscuous capture also sees unicast between LAN peers and to the host, which must not be bridged.
+func forGateway(dst []byte, mac net.HardwareAddr) bool {
+	return dst[0]&0x01 != 0 || bytes.Equal(dst, mac)
+}
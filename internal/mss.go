@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"encoding/binary"
+	"log/slog"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const tcpOptionMSS = 2
+
+// MSSConfig clamps the TCP MSS announced in SYN and SYN-ACK segments crossing the bridge
+type MSSConfig struct {
+	Enabled bool `json:"enabled"`
+	// MSS is the IPv4 clamp, 0 derives it from the TUN MTU. IPv6 uses 20 bytes less for its larger header.
+	MSS int `json:"mss"`
+}
+
+func (b *Bridge) setupMSSClamp(cfg MSSConfig) {
+	mss := cfg.MSS
+	if mss <= 0 {
+		mtu := b.to.MTU()
+		if mtu <= 0 {
+			slog.Warn("TUN MTU is unknown, MSS clamping is off")
+			return
+		}
+		mss = mtu - header.IPv4MinimumSize - header.TCPMinimumSize
+	}
+
+	b.mss4 = uint16(mss)
+	b.mss6 = uint16(mss - (header.IPv6MinimumSize - header.IPv4MinimumSize))
+	slog.Info("Clamping TCP MSS", "ipv4", b.mss4, "ipv6", b.mss6)
+}
+
+// clampMSS lowers the MSS option of a TCP SYN in the IP packet, fixing the checksum in place
+func (b *Bridge) clampMSS(proto tcpip.NetworkProtocolNumber, packet []byte) {
+	var segment []byte
+	var limit uint16
+
+	switch proto {
+	case header.IPv4ProtocolNumber:
+		ip := header.IPv4(packet)
+		if !ip.IsValid(len(packet)) || ip.TransportProtocol() != header.TCPProtocolNumber || ip.FragmentOffset() != 0 {
+			return
+		}
+		segment, limit = ip.Payload(), b.mss4
+	case header.IPv6ProtocolNumber:
+		// Only TCP right after the fixed header, extension headers are rare on SYNs
+		ip := header.IPv6(packet)
+		if !ip.IsValid(len(packet)) || ip.NextHeader() != uint8(header.TCPProtocolNumber) {
+			return
+		}
+		segment, limit = ip.Payload(), b.mss6
+	default:
+		return
+	}
+
+	if limit == 0 || len(segment) < header.TCPMinimumSize {
+		return
+	}
+	tcp := header.TCP(segment)
+	if tcp.Flags()&header.TCPFlagSyn == 0 {
+		return
+	}
+
+	offset := int(tcp.DataOffset())
+	if offset < header.TCPMinimumSize || offset > len(segment) {
+		return
+	}
+
+	opts := segment[header.TCPMinimumSize:offset]
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case header.TCPOptionEOL:
+			return
+		case header.TCPOptionNOP:
+			i++
+			continue
+		}
+
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			return
+		}
+		if opts[i] == tcpOptionMSS && opts[i+1] == 4 {
+			mss := binary.BigEndian.Uint16(opts[i+2:])
+			if mss > limit {
+				binary.BigEndian.PutUint16(opts[i+2:], limit)
+				pos := header.TCPMinimumSize + i + 2
+				tcp.SetChecksum(checksumUpdate(tcp.Checksum(), mss, limit, pos%2 == 1))
+			}
+			return
+		}
+		i += int(opts[i+1])
+	}
+}
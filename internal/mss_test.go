@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// onesSum is the internet checksum of data, computed in full
+func onesSum(data ...[]byte) uint16 {
+	var sum uint32
+	var odd bool
+	for _, d := range data {
+		for _, b := range d {
+			if odd {
+				sum += uint32(b)
+			} else {
+				sum += uint32(b) << 8
+			}
+			odd = !odd
+		}
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+func TestChecksumUpdate(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	data := make([]byte, 64)
+	for range 1000 {
+		for i := range data {
+			data[i] = byte(r.Uint32())
+		}
+		sum := onesSum(data)
+
+		pos := r.IntN(len(data) - 1)
+		old := binary.BigEndian.Uint16(data[pos:])
+		val := uint16(r.Uint32())
+		binary.BigEndian.PutUint16(data[pos:], val)
+
+		if got, want := checksumUpdate(sum, old, val, pos%2 == 1), onesSum(data); got != want {
+			t.Fatalf("word at %d %#04x -> %#04x: checksum %#04x, want %#04x", pos, old, val, got, want)
+		}
+	}
+}
+
+// tcpChecksum recomputes the checksum of the TCP segment in the IP packet
+func tcpChecksum(proto tcpip.NetworkProtocolNumber, packet []byte) uint16 {
+	var src, dst, seg []byte
+	if proto == header.IPv4ProtocolNumber {
+		ip := header.IPv4(packet)
+		src, dst, seg = ip.SourceAddressSlice(), ip.DestinationAddressSlice(), ip.Payload()
+	} else {
+		ip := header.IPv6(packet)
+		src, dst, seg = ip.SourceAddressSlice(), ip.DestinationAddressSlice(), ip.Payload()
+	}
+
+	pseudo := binary.BigEndian.AppendUint16(nil, uint16(header.TCPProtocolNumber))
+	pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(seg)))
+	// The checksum field counts as zero
+	return onesSum(src, dst, pseudo, seg[:16], []byte{0, 0}, seg[18:])
+}
+
+var (
+	tcpNOP  = layers.TCPOption{OptionType: layers.TCPOptionKindNop, OptionLength: 1}
+	tcpSACK = layers.TCPOption{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2}
+	tcpWS   = layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}}
+)
+
+func tcpMSS(mss uint16) layers.TCPOption {
+	return layers.TCPOption{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: binary.BigEndian.AppendUint16(nil, mss)}
+}
+
+func TestClampMSS(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		ipv6    bool
+		syn     bool
+		ack     bool
+		opts    []layers.TCPOption
+		payload string
+		// truncate lowers the data offset so the options area ends inside the MSS option
+		truncate bool
+		want     uint16
+	}{
+		{name: "syn", syn: true, opts: []layers.TCPOption{tcpMSS(1460)}, want: 1200},
+		{name: "syn-ack", syn: true, ack: true, opts: []layers.TCPOption{tcpMSS(1460), tcpSACK}, want: 1200},
+		{name: "odd offset", syn: true, opts: []layers.TCPOption{tcpNOP, tcpMSS(1460), tcpNOP, tcpWS}, want: 1200},
+		{name: "not first", syn: true, ack: true, opts: []layers.TCPOption{tcpSACK, tcpNOP, tcpWS, tcpMSS(1460)}, payload: "x", want: 1200},
+		{name: "already lower", syn: true, opts: []layers.TCPOption{tcpMSS(1000)}, want: 1000},
+		{name: "not syn", ack: true, opts: []layers.TCPOption{tcpMSS(1460)}, want: 1460},
+		{name: "truncated", syn: true, opts: []layers.TCPOption{tcpNOP, tcpNOP, tcpNOP, tcpMSS(1460)}, truncate: true, want: 1460},
+		{name: "ipv6", ipv6: true, syn: true, opts: []layers.TCPOption{tcpNOP, tcpMSS(1440)}, want: 1180},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, Seq: 1, SYN: tc.syn, ACK: tc.ack, Window: 65535, Options: tc.opts}
+			var ip gopacket.NetworkLayer
+			proto := tcpip.NetworkProtocolNumber(header.IPv4ProtocolNumber)
+			if tc.ipv6 {
+				ip = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: net.ParseIP("fd00::2"), DstIP: net.ParseIP("2001:db8::1")}
+				proto = header.IPv6ProtocolNumber
+			} else {
+				ip = &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: testClientIP, DstIP: testRemoteIP}
+			}
+			tcp.SetNetworkLayerForChecksum(ip)
+			packet := serialize(t, ip.(gopacket.SerializableLayer), tcp, gopacket.Payload(tc.payload))
+
+			hl := header.IPv4MinimumSize
+			if tc.ipv6 {
+				hl = header.IPv6MinimumSize
+			}
+			seg := packet[hl:]
+			if sum := header.TCP(seg).Checksum(); sum != tcpChecksum(proto, packet) {
+				t.Fatalf("built checksum %#04x, recomputed %#04x", sum, tcpChecksum(proto, packet))
+			}
+
+			// The MSS value follows the first kind 2 length 4 in the options
+			pos := bytes.Index(seg[header.TCPMinimumSize:header.TCP(seg).DataOffset()], []byte{tcpOptionMSS, 4})
+			if pos < 0 {
+				t.Fatal("no mss option built")
+			}
+			pos += header.TCPMinimumSize + 2
+			if tc.truncate {
+				seg[12] = (header.TCPMinimumSize + 4) / 4 << 4
+			}
+
+			before := slices.Clone(packet)
+			b := &Bridge{mss4: 1200, mss6: 1180}
+			b.clampMSS(proto, packet)
+
+			if got := binary.BigEndian.Uint16(seg[pos:]); got != tc.want {
+				t.Fatalf("mss %d, want %d", got, tc.want)
+			}
+			if got := binary.BigEndian.Uint16(before[hl+pos:]); got == tc.want {
+				if !bytes.Equal(packet, before) {
+					t.Fatal("segment left alone was changed")
+				}
+				return
+			}
+			if sum := header.TCP(seg).Checksum(); sum != tcpChecksum(proto, packet) {
+				t.Fatalf("checksum %#04x, recomputed %#04x", sum, tcpChecksum(proto, packet))
+			}
+		})
+	}
+}
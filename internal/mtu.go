@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"log/slog"
+	"net"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// ipv4OptionCopied marks options repeated in every fragment (RFC 791)
+const ipv4OptionCopied = 0x80
+
+func (b *Bridge) setupMTU() {
+	b.mtuL2 = b.from.MTU()
+	b.mtuL3 = b.to.MTU()
+	slog.Info("Bridge MTU", "l2", b.mtuL2, "l3", b.mtuL3)
+	if b.mtuL2 > 0 && b.mtuL3 > 0 && b.mtuL2 != b.mtuL3 {
+		slog.Warn("L2 and TUN MTUs differ, oversized packets are fragmented or refused", "l2", b.mtuL2, "l3", b.mtuL3)
+	}
+}
+
+// forwardL3 sends the IP packet at frame[off:] to the L3 side, fragmenting or refusing
+// it when it exceeds the TUN MTU
+func (b *Bridge) forwardL3(tx *txBatch, frame []byte, off int, proto tcpip.NetworkProtocolNumber) {
+	n, ok := ipLength(proto, frame[off:])
+	if !ok {
+		return
+	}
+	// Drop the Ethernet padding of short frames
+	frame = frame[:off+n]
+
+	if b.mtuL3 <= 0 || n <= b.mtuL3 {
+		if err := b.sendL3(tx, frame, off, proto); err != nil {
+			slog.Debug("write l3 error", "err", err)
+		}
+		return
+	}
+
+	packet := frame[off:]
+	if proto == header.IPv4ProtocolNumber && header.IPv4(packet).Flags()&header.IPv4FlagDontFragment == 0 {
+		hl := b.tunFraming.HeaderLen()
+		for _, frag := range fragmentIPv4(packet, b.mtuL3, hl) {
+			if err := b.sendL3(tx, frag, hl, proto); err != nil {
+				slog.Debug("write l3 error", "err", err)
+				return
+			}
+		}
+		return
+	}
+
+	reply, err := b.icmpError(proto, packet, icmpTooBig, b.mtuL3)
+	if err != nil {
+		slog.Error("build icmp too big error", "err", err)
+		return
+	}
+	if reply != nil {
+		b.writeL2(net.HardwareAddr(frame[6:12]), proto, reply)
+	}
+}
+
+// forwardL2 sends the IP packet to dstMAC on the L2 side, fragmenting or refusing
+// it when it exceeds the L2 MTU
+func (b *Bridge) forwardL2(tx *txBatch, dstMAC net.HardwareAddr, proto tcpip.NetworkProtocolNumber, packet []byte) {
+	n, ok := ipLength(proto, packet)
+	if !ok {
+		return
+	}
+	packet = packet[:n]
+
+	if b.mtuL2 <= 0 || n <= b.mtuL2 {
+		b.sendL2(tx, dstMAC, proto, packet)
+		return
+	}
+
+	if proto == header.IPv4ProtocolNumber && header.IPv4(packet).Flags()&header.IPv4FlagDontFragment == 0 {
+		for _, frag := range fragmentIPv4(packet, b.mtuL2, 0) {
+			b.sendL2(tx, dstMAC, proto, frag)
+		}
+		return
+	}
+
+	reply, err := b.icmpError(proto, packet, icmpTooBig, b.mtuL2)
+	if err != nil {
+		slog.Error("build icmp too big error", "err", err)
+		return
+	}
+	if reply == nil {
+		return
+	}
+	if err := b.writeL3(reply, 0, proto); err != nil {
+		slog.Error("send icmp too big error", "err", err)
+	}
+}
+
+// ipLength returns the length of the IP packet without link padding, false if it is truncated
+func ipLength(proto tcpip.NetworkProtocolNumber, packet []byte) (int, bool) {
+	var n int
+	switch proto {
+	case header.IPv4ProtocolNumber:
+		if len(packet) < header.IPv4MinimumSize {
+			return 0, false
+		}
+		n = int(header.IPv4(packet).TotalLength())
+		if n < int(header.IPv4(packet).HeaderLength()) {
+			return 0, false
+		}
+	case header.IPv6ProtocolNumber:
+		if len(packet) < header.IPv6MinimumSize {
+			return 0, false
+		}
+		n = header.IPv6MinimumSize + int(header.IPv6(packet).PayloadLength())
+	default:
+		return len(packet), true
+	}
+
+	return n, n <= len(packet)
+}
+
+// fragmentIPv4 splits the IPv4 packet into fragments of at most mtu bytes, each with
+// headroom free bytes in front of it. Options without the copied flag stay in the first fragment.
+func fragmentIPv4(packet []byte, mtu, headroom int) [][]byte {
+	ip := header.IPv4(packet)
+	hl := int(ip.HeaderLength())
+	payload := packet[hl:ip.TotalLength()]
+	offset := int(ip.FragmentOffset())
+	lastMF := ip.Flags()&header.IPv4FlagMoreFragments != 0
+
+	first := packet[:hl]
+	rest := copiedOptionsHeader(first)
+
+	var frags [][]byte
+	for hdr := first; len(payload) > 0; hdr = rest {
+		size := min(len(payload), (mtu-len(hdr))&^7)
+		if size <= 0 {
+			return nil
+		}
+
+		buf := make([]byte, headroom+len(hdr)+size)
+		frag := header.IPv4(buf[headroom:])
+		copy(frag, hdr)
+		copy(frag[len(hdr):], payload[:size])
+		payload = payload[size:]
+
+		var flags uint8
+		if len(payload) > 0 || lastMF {
+			flags = header.IPv4FlagMoreFragments
+		}
+		frag.SetHeaderLength(uint8(len(hdr)))
+		frag.SetTotalLength(uint16(len(hdr) + size))
+		frag.SetFlagsFragmentOffset(flags, uint16(offset))
+		frag.SetChecksum(0)
+		frag.SetChecksum(^frag.CalculateChecksum())
+
+		frags = append(frags, buf)
+		offset += size
+	}
+
+	return frags
+}
+
+// copiedOptionsHeader returns the IPv4 header for fragments after the first,
+// keeping only the options that must be copied
+func copiedOptionsHeader(hdr []byte) []byte {
+	out := make([]byte, header.IPv4MinimumSize, len(hdr))
+	copy(out, hdr[:header.IPv4MinimumSize])
+
+	opts := hdr[header.IPv4MinimumSize:]
+	for len(opts) > 0 {
+		kind := header.IPv4OptionType(opts[0])
+		if kind == header.IPv4OptionListEndType {
+			break
+		}
+		if kind == header.IPv4OptionNOPType {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			break
+		}
+		if kind&ipv4OptionCopied != 0 {
+			out = append(out, opts[:opts[1]]...)
+		}
+		opts = opts[opts[1]:]
+	}
+
+	// Pad the options to a multiple of 4 bytes with end of list
+	for len(out)%4 != 0 {
+		out = append(out, byte(header.IPv4OptionListEndType))
+	}
+	return out
+}
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// bigUDPLayers is udpLayers with a payload of n bytes and the don't fragment flag as asked
+func bigUDPLayers(src, dst net.IP, n int, df bool) []gopacket.SerializableLayer {
+	payload := make([]byte, n)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	l := udpLayers(src, dst, string(payload))
+	ip := l[0].(*layers.IPv4)
+	ip.Id = 0x1234
+	if df {
+		ip.Flags = layers.IPv4DontFragment
+	}
+	return l
+}
+
+// checkFragments checks the fragments of packet and that they reassemble to it
+func checkFragments(t *testing.T, packet []byte, frags [][]byte, mtu int) {
+	t.Helper()
+
+	orig := header.IPv4(packet)
+	payload := make([]byte, len(orig.Payload()))
+	for i, frag := range frags {
+		ip := header.IPv4(frag)
+		if !ip.IsValid(len(frag)) || ip.CalculateChecksum() != 0xffff {
+			t.Fatalf("fragment %d has a bad header or checksum", i)
+		}
+		if len(frag) > mtu {
+			t.Fatalf("fragment %d is %d bytes, mtu %d", i, len(frag), mtu)
+		}
+		if ip.ID() != orig.ID() {
+			t.Fatalf("fragment %d id %#x, want %#x", i, ip.ID(), orig.ID())
+		}
+		off := int(ip.FragmentOffset())
+		if off%8 != 0 {
+			t.Fatalf("fragment %d offset %d is no multiple of 8", i, off)
+		}
+		mf := ip.Flags()&header.IPv4FlagMoreFragments != 0
+		if last := i == len(frags)-1; mf == last {
+			t.Fatalf("fragment %d of %d has more fragments %v", i, len(frags), mf)
+		}
+		copy(payload[off:], ip.Payload())
+	}
+	if !bytes.Equal(payload, orig.Payload()) {
+		t.Fatal("fragments don't reassemble to the payload")
+	}
+}
+
+func TestFragmentIPv4(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		size    int
+		mtu     int
+		options layers.IPv4Option
+	}{
+		{name: "two", size: 1400, mtu: 1280},
+		{name: "many", size: 4000, mtu: 576},
+		{name: "odd mtu", size: 3000, mtu: 1001},
+		// Record route isn't copied, security is, the later fragments keep only that
+		{name: "options", size: 2000, mtu: 600, options: layers.IPv4Option{OptionType: 0x07, OptionLength: 7, OptionData: make([]byte, 5)}},
+		{name: "copied option", size: 2000, mtu: 600, options: layers.IPv4Option{OptionType: 0x82, OptionLength: 4, OptionData: make([]byte, 2)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := bigUDPLayers(testClientIP, testRemoteIP, tc.size, false)
+			if tc.options.OptionType != 0 {
+				l[0].(*layers.IPv4).Options = []layers.IPv4Option{tc.options}
+			}
+			packet := serialize(t, l...)
+
+			for _, headroom := range []int{0, 4} {
+				frags := fragmentIPv4(packet, tc.mtu, headroom)
+				if len(frags) < 2 {
+					t.Fatalf("%d fragments", len(frags))
+				}
+				for i := range frags {
+					frags[i] = frags[i][headroom:]
+				}
+				checkFragments(t, packet, frags, tc.mtu)
+
+				hl := int(header.IPv4(frags[1]).HeaderLength())
+				if tc.options.OptionType&ipv4OptionCopied != 0 && hl == header.IPv4MinimumSize {
+					t.Fatal("copied option missing from a later fragment")
+				}
+				if tc.options.OptionType != 0 && tc.options.OptionType&ipv4OptionCopied == 0 && hl != header.IPv4MinimumSize {
+					t.Fatal("option that isn't copied repeated in a later fragment")
+				}
+			}
+		})
+	}
+}
+
+func TestFragmentIPv4Fragment(t *testing.T) {
+	// A fragment with more to come keeps the flag on its last piece and its offset
+	l := bigUDPLayers(testClientIP, testRemoteIP, 1400, false)
+	ip := l[0].(*layers.IPv4)
+	ip.Flags, ip.FragOffset = layers.IPv4MoreFragments, 100
+	packet := serialize(t, l...)
+
+	frags := fragmentIPv4(packet, 576, 0)
+	for i, frag := range frags {
+		if header.IPv4(frag).Flags()&header.IPv4FlagMoreFragments == 0 {
+			t.Fatalf("fragment %d lost more fragments", i)
+		}
+	}
+	if off := header.IPv4(frags[0]).FragmentOffset(); off != 800 {
+		t.Fatalf("first offset %d, want 800", off)
+	}
+}
+
+// collectFragments reads n fragments of the packet with id from p, in order
+func collectFragments(t *testing.T, p *Pipe, first gopacket.Decoder, id uint16, n int) [][]byte {
+	t.Helper()
+
+	var frags [][]byte
+	for range n {
+		packet := expect(t, p, first, func(p gopacket.Packet) bool {
+			ip, ok := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			return ok && ip.Id == id
+		})
+		ip := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		frags = append(frags, append(ip.Contents, ip.Payload...))
+	}
+	return frags
+}
+
+// isTooBig matches the ICMP fragmentation needed from the gateway to dst with the mtu
+func isTooBig(dst net.IP, mtu int) func(gopacket.Packet) bool {
+	return func(p gopacket.Packet) bool {
+		ip, ok := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		icmp, _ := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+		return ok && icmp != nil && ip.SrcIP.Equal(testGatewayIP) && ip.DstIP.Equal(dst) &&
+			icmp.TypeCode == layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded) &&
+			int(icmp.Seq) == mtu
+	}
+}
+
+func TestFragmentL2ToL3(t *testing.T) {
+	_, lan, tun := startTestBridgeMTU(t, testConfig(), 1500, 1280)
+	eth := &layers.Ethernet{SrcMAC: testClientMAC, DstMAC: testNICMAC, EthernetType: layers.EthernetTypeIPv4}
+
+	l := bigUDPLayers(testClientIP, testRemoteIP, 1400, false)
+	lan.Write(serialize(t, append([]gopacket.SerializableLayer{eth}, l...)...))
+	checkFragments(t, serialize(t, l...), collectFragments(t, tun, layers.LayerTypeIPv4, 0x1234, 2), 1280)
+
+	lan.Write(serialize(t, append([]gopacket.SerializableLayer{eth}, bigUDPLayers(testClientIP, testRemoteIP, 1400, true)...)...))
+	packet := expect(t, lan, layers.LayerTypeEthernet, isTooBig(testClientIP, 1280))
+	if dst := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet).DstMAC; !bytes.Equal(dst, testClientMAC) {
+		t.Fatalf("fragmentation needed sent to %s", dst)
+	}
+}
+
+func TestFragmentL3ToL2(t *testing.T) {
+	_, lan, tun := startTestBridgeMTU(t, testConfig(), 1280, 1500)
+
+	// The client's first packet teaches the bridge its MAC
+	lan.Write(udpFrame(t, testClientMAC, testNICMAC, testClientIP, testRemoteIP, "query"))
+	expect(t, tun, layers.LayerTypeIPv4, isUDP(testClientIP, testRemoteIP, "query"))
+
+	l := bigUDPLayers(testRemoteIP, testClientIP, 1400, false)
+	packet := serialize(t, l...)
+	tun.Write(packet)
+	checkFragments(t, packet, collectFragments(t, lan, layers.LayerTypeEthernet, 0x1234, 2), 1280)
+
+	tun.Write(serialize(t, bigUDPLayers(testRemoteIP, testClientIP, 1400, true)...))
+	expect(t, tun, layers.LayerTypeIPv4, isTooBig(testRemoteIP, 1280))
+}
@@ -0,0 +1,371 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+const (
+	// neighborRefresh is how often a reachable entry takes the write lock to note its sender is alive
+	neighborRefresh      = time.Second
+	defaultReachableTime = 30 * time.Second
+	defaultStaleTime     = 10 * time.Minute
+	defaultMaxNeighbors  = 1024
+)
+
+// NeighborConfig controls the IP to MAC cache of the L2 side
+type NeighborConfig struct {
+	// ReachableTime is how long a learned MAC is used before it is probed again
+	ReachableTime Duration `json:"reachable_time"`
+	// StaleTime is how long an entry that stopped answering probes is kept
+	StaleTime  Duration `json:"stale_time"`
+	MaxEntries int      `json:"max_entries"`
+	// File keeps the cache across restarts, empty disables it
+	File string `json:"file"`
+}
+
+type neighborState uint8
+
+const (
+	// neighborIncomplete is being resolved and holds the packets waiting for it
+	neighborIncomplete neighborState = iota
+	neighborReachable
+	// neighborStale is still used for forwarding while it is probed
+	neighborStale
+	// neighborStatic comes from the config and never ages
+	neighborStatic
+)
+
+func (s neighborState) String() string {
+	switch s {
+	case neighborIncomplete:
+		return "incomplete"
+	case neighborReachable:
+		return "reachable"
+	case neighborStale:
+		return "stale"
+	case neighborStatic:
+		return "static"
+	default:
+		return "unknown"
+	}
+}
+
+type neighbor struct {
+	ip      net.IP
+	mac     net.HardwareAddr
+	state   neighborState
+	updated time.Time
+	probes  int
+	rtt     time.Duration
+
+	proto   tcpip.NetworkProtocolNumber
+	packets [][]byte
+}
+
+// Neighbor is a neighbor cache entry as shown by the API and kept in NeighborConfig.File
+type Neighbor struct {
+	IP      string    `json:"ip"`
+	MAC     string    `json:"mac"`
+	State   string    `json:"state"`
+	Updated time.Time `json:"updated"`
+	// RTT is the last ping from the gateway in milliseconds, see PingConfig
+	RTT float64 `json:"rtt_ms,omitempty"`
+}
+
+func (b *Bridge) setupNeighbors(cfg NeighborConfig) error {
+	b.neighborCfg = cfg
+	if b.neighborCfg.ReachableTime <= 0 {
+		b.neighborCfg.ReachableTime = Duration(defaultReachableTime)
+	}
+	if b.neighborCfg.StaleTime <= 0 {
+		b.neighborCfg.StaleTime = Duration(defaultStaleTime)
+	}
+	if b.neighborCfg.MaxEntries <= 0 {
+		b.neighborCfg.MaxEntries = defaultMaxNeighbors
+	}
+
+	if cfg.File == "" {
+		return nil
+	}
+	return b.loadNeighbors()
+}
+
+// StoreMAC records mac as the confirmed address of ip and sends the packets waiting for it
+func (b *Bridge) StoreMAC(ip netip.Addr, mac net.HardwareAddr) {
+	now := time.Now()
+
+	// Every forwarded packet confirms its sender, most of them change nothing
+	b.mapMux.RLock()
+	e, ok := b.neighbors[ip]
+	fresh := ok && e.state == neighborReachable && now.Sub(e.updated) < neighborRefresh && bytes.Equal(e.mac, mac)
+	b.mapMux.RUnlock()
+	if fresh {
+		return
+	}
+
+	b.mapMux.Lock()
+	e, ok = b.neighbors[ip]
+	if ok && e.state == neighborStatic {
+		b.mapMux.Unlock()
+		return
+	}
+	if !ok {
+		if !b.evictNeighborLocked() {
+			b.mapMux.Unlock()
+			return
+		}
+		e = &neighbor{ip: net.IP(ip.AsSlice())}
+		b.neighbors[ip] = e
+	}
+
+	// The frame mac points into is reused by the backend
+	if !bytes.Equal(e.mac, mac) {
+		if e.mac != nil {
+			slog.Info("neighbor moved", "ip", ip, "old", e.mac.String(), "mac", mac.String())
+		}
+		e.mac = bytes.Clone(mac)
+	}
+
+	var packets [][]byte
+	if e.state == neighborIncomplete {
+		packets, e.packets = e.packets, nil
+		b.incomplete--
+	}
+	e.state = neighborReachable
+	e.updated = now
+	e.probes = 0
+	dstMAC, proto := e.mac, e.proto
+	b.mapMux.Unlock()
+
+	for _, packet := range packets {
+		b.forwardL2(nil, dstMAC, proto, packet)
+	}
+}
+
+// seedNeighbor adds a mapping that has not been confirmed yet, like a DHCP lease or a saved entry
+func (b *Bridge) seedNeighbor(ip netip.Addr, mac net.HardwareAddr, updated time.Time) {
+	b.mapMux.Lock()
+	defer b.mapMux.Unlock()
+
+	if _, ok := b.neighbors[ip]; ok || !b.evictNeighborLocked() {
+		return
+	}
+
+	b.neighbors[ip] = &neighbor{
+		ip:      net.IP(ip.AsSlice()),
+		mac:     bytes.Clone(mac),
+		state:   neighborStale,
+		updated: updated,
+	}
+}
+
+// staticNeighbor pins ip to mac, learned addresses never replace it
+func (b *Bridge) staticNeighbor(ip netip.Addr, mac net.HardwareAddr) {
+	b.mapMux.Lock()
+	defer b.mapMux.Unlock()
+
+	b.neighbors[ip] = &neighbor{
+		ip:      net.IP(ip.AsSlice()),
+		mac:     mac,
+		state:   neighborStatic,
+		updated: time.Now(),
+	}
+}
+
+func (b *Bridge) GetMAC(ip netip.Addr) (net.HardwareAddr, bool) {
+	b.mapMux.RLock()
+	defer b.mapMux.RUnlock()
+
+	e, ok := b.neighbors[ip]
+	if !ok || e.state == neighborIncomplete {
+		return nil, false
+	}
+	return e.mac, true
+}
+
+// neighborKey returns the cache key of ip, IPv4 addresses in their 4-byte form
+func neighborKey(ip net.IP) netip.Addr {
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
+
+// evictNeighborLocked makes room for one entry, dropping the oldest stale or reachable one.
+// It reports false when the cache is full of incomplete and static entries.
+func (b *Bridge) evictNeighborLocked() bool {
+	if len(b.neighbors) < b.neighborCfg.MaxEntries {
+		return true
+	}
+
+	var oldest netip.Addr
+	var victim *neighbor
+	for ip, e := range b.neighbors {
+		if e.state == neighborIncomplete || e.state == neighborStatic {
+			continue
+		}
+		if victim == nil || e.state > victim.state || e.state == victim.state && e.updated.Before(victim.updated) {
+			oldest, victim = ip, e
+		}
+	}
+	if victim == nil {
+		return false
+	}
+
+	delete(b.neighbors, oldest)
+	return true
+}
+
+// maintainNeighbors ages the cache, probes stale entries and gives up on unresolved ones
+func (b *Bridge) maintainNeighbors(ctx context.Context) {
+	ticker := time.NewTicker(resolveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			b.ageNeighbors(now)
+			if b.dhcp != nil {
+				b.dhcp.expireOffers(now)
+			}
+		}
+	}
+}
+
+func (b *Bridge) ageNeighbors(now time.Time) {
+	reachable := time.Duration(b.neighborCfg.ReachableTime)
+	stale := time.Duration(b.neighborCfg.StaleTime)
+
+	var probe []net.IP
+	var failed []*neighbor
+
+	b.mapMux.Lock()
+	for ip, e := range b.neighbors {
+		switch e.state {
+		case neighborIncomplete:
+			if e.probes >= resolveRetries {
+				delete(b.neighbors, ip)
+				b.incomplete--
+				failed = append(failed, e)
+				continue
+			}
+		case neighborReachable:
+			if now.Sub(e.updated) < reachable {
+				continue
+			}
+			e.state = neighborStale
+			e.probes = 0
+		case neighborStale:
+			if now.Sub(e.updated) >= reachable+stale {
+				slog.Debug("neighbor expired", "ip", ip, "mac", e.mac.String())
+				delete(b.neighbors, ip)
+				continue
+			}
+			if e.probes >= resolveRetries {
+				continue
+			}
+		case neighborStatic:
+			continue
+		}
+
+		e.probes++
+		probe = append(probe, e.ip)
+	}
+	b.mapMux.Unlock()
+
+	for _, ip := range probe {
+		b.solicit(ip)
+	}
+
+	for _, e := range failed {
+		slog.Debug("neighbor unreachable", "ip", e.ip, "dropped", len(e.packets))
+		for _, packet := range e.packets {
+			b.writeUnreachable(e.proto, packet)
+		}
+	}
+}
+
+// Neighbors returns a snapshot of the neighbor cache ordered by address
+func (b *Bridge) Neighbors() []Neighbor {
+	b.mapMux.RLock()
+	list := make([]Neighbor, 0, len(b.neighbors))
+	for ip, e := range b.neighbors {
+		list = append(list, Neighbor{
+			IP:      ip.String(),
+			MAC:     e.mac.String(),
+			State:   e.state.String(),
+			Updated: e.updated,
+			RTT:     float64(e.rtt) / float64(time.Millisecond),
+		})
+	}
+	b.mapMux.RUnlock()
+
+	slices.SortFunc(list, func(x, y Neighbor) int {
+		return bytes.Compare(net.ParseIP(x.IP).To16(), net.ParseIP(y.IP).To16())
+	})
+	return list
+}
+
+func (b *Bridge) loadNeighbors() error {
+	data, err := os.ReadFile(b.neighborCfg.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read neighbors error: %w", err)
+	}
+
+	var list []Neighbor
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("parse neighbors error: %w", err)
+	}
+
+	for _, n := range list {
+		ip, err := netip.ParseAddr(n.IP)
+		if err != nil {
+			continue
+		}
+		mac, err := net.ParseMAC(n.MAC)
+		if err != nil {
+			continue
+		}
+		if b.network.Contains(ip.AsSlice()) || b.network6 != nil && b.network6.Contains(ip.AsSlice()) {
+			b.seedNeighbor(ip.Unmap(), mac, n.Updated)
+		}
+	}
+
+	return nil
+}
+
+func (b *Bridge) saveNeighbors() {
+	if b.neighborCfg.File == "" {
+		return
+	}
+
+	// Static entries live in the config
+	list := slices.DeleteFunc(b.Neighbors(), func(n Neighbor) bool {
+		return n.State == neighborIncomplete.String() || n.State == neighborStatic.String()
+	})
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		slog.Error("marshal neighbors error", "err", err)
+		return
+	}
+
+	if err := os.WriteFile(b.neighborCfg.File, data, 0644); err != nil {
+		slog.Error("write neighbors error", "err", err)
+	}
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+// PacketIO is a link the bridge reads frames from and writes frames to.
+// PCAP is the default implementation, Pipe is an in-memory one for tests.
+type PacketIO interface {
+	// Read blocks for the next frame and returns nil on error or when nothing arrived
+	// within readTimeout, so the caller can notice it is being stopped.
+	// A frame is borrowed from the backend, which may reuse the memory or share it with
+	// the kernel or libpcap. The caller may change it in place, must copy what it keeps
+	// and must call Release before reading again. Other readers block until then.
+	Read() []byte
+	// Release hands the frame of the last successful Read back to the backend
+	Release()
+	// Write sends a frame, the caller reuses p once it returns. It returns within writeTimeout
+	// even on a link that doesn't drain, so the bridge can stop.
+	Write(p []byte) error
+	Close()
+	LinkType() layers.LinkType
+	MTU() int
+	MAC() net.HardwareAddr
+}
+
+// MACFilter is implemented by backends that can drop unicast frames for other hosts
+// in the kernel, before they are copied to the bridge
+type MACFilter interface {
+	SetMACFilter(mac net.HardwareAddr) error
+}
+
+// BatchReader is implemented by backends that can return several frames per system call
+type BatchReader interface {
+	// ReadBatch fills frames with up to len(frames) borrowed frames and returns how many,
+	// 0 like a nil Read. One Release hands all of them back.
+	ReadBatch(frames [][]byte) int
+}
+
+// BatchWriter is implemented by backends that can send several frames per system call
+type BatchWriter interface {
+	// WriteBatch sends the frames in order, the caller reuses them once it returns
+	WriteBatch(frames [][]byte) error
+}
+
+// Queues is implemented by backends that can open more queues on the same link, such as
+// af_packet fanout groups. The kernel spreads the flows over them.
+type Queues interface {
+	// OpenQueue opens one more queue, closed by its caller. It fails with errors.ErrUnsupported
+	// when the link can't have queues.
+	OpenQueue() (PacketIO, error)
+}
+
+const (
+	BackendPCAP     = "pcap"
+	BackendAFPacket = "afpacket"
+)
+
+// readTimeout bounds how long a backend blocks in Read
+const readTimeout = 250 * time.Millisecond
+
+// writeTimeout bounds how long a backend blocks in Write on a link that doesn't drain,
+// so the bridge can stop
+const writeTimeout = time.Second
+
+// OpenPacketIO opens the backend selected for an interface, pcap by default
+func OpenPacketIO(cfg InterfaceConfig) (PacketIO, error) {
+	io, err := openBackend(cfg)
+	if err != nil || cfg.VLAN == 0 {
+		return io, err
+	}
+
+	tagged, err := newVLAN(io, cfg.VLAN)
+	if err != nil {
+		io.Close()
+		return nil, fmt.Errorf("%s: %w", cfg.Name, err)
+	}
+	return tagged, nil
+}
+
+func openBackend(cfg InterfaceConfig) (PacketIO, error) {
+	switch cfg.Backend {
+	case "", BackendPCAP:
+		return openPCAP(cfg)
+	case BackendAFPacket:
+		return openAFPacket(cfg)
+	case "tun":
+		// Attaching to the sing-box tun through /dev/net/tun took packets meant for sing-box
+		// and handed ours to the host instead, af_packet reaches sing-box the right way round
+		return nil, fmt.Errorf("the tun backend was removed, use %q for %s", BackendAFPacket, cfg.Name)
+	default:
+		return nil, fmt.Errorf("unknown backend %q for %s", cfg.Backend, cfg.Name)
+	}
+}
+
+// addressing is the parsed network layout of an InterfaceConfig
+type addressing struct {
+	network   *net.IPNet
+	broadcast net.IP
+	localIP   net.IP
+	network6  *net.IPNet
+	localIP6  net.IP
+}
+
+func parseAddressing(cfg InterfaceConfig) (addressing, error) {
+	var a addressing
+	var err error
+
+	_, a.network, err = net.ParseCIDR(cfg.Network)
+	if err != nil {
+		return a, fmt.Errorf("parse cidr error: %w", err)
+	}
+
+	a.localIP = net.ParseIP(cfg.LocalIP)
+	if a.localIP == nil {
+		return a, fmt.Errorf("invalid local IP: %s", cfg.LocalIP)
+	}
+
+	a.localIP = a.localIP.To4()
+	if !a.network.Contains(a.localIP) {
+		return a, fmt.Errorf("local ip (%s) not in network (%s)", a.localIP, a.network)
+	}
+	a.broadcast = broadcastAddr(a.network)
+
+	if cfg.Network6 == "" {
+		return a, nil
+	}
+
+	_, a.network6, err = net.ParseCIDR(cfg.Network6)
+	if err != nil {
+		return a, fmt.Errorf("parse ipv6 cidr error: %w", err)
+	}
+
+	a.localIP6 = net.ParseIP(cfg.LocalIP6)
+	if a.localIP6 == nil || a.localIP6.To4() != nil {
+		return a, fmt.Errorf("invalid local IPv6: %s", cfg.LocalIP6)
+	}
+
+	if !a.network6.Contains(a.localIP6) {
+		return a, fmt.Errorf("local ipv6 (%s) not in network (%s)", a.localIP6, a.network6)
+	}
+
+	return a, nil
+}
@@ -1,3 +1,5 @@
+//go:build cgo
+
 package internal
 
 import (
@@ -6,9 +8,24 @@ import (
 	"net"
 	"sync"
 
+	"github.com/gopacket/gopacket/layers"
 	"github.com/gopacket/gopacket/pcap"
 )
 
+const (
+	pcapSnapLen = 1600
+	// pcapLinkSlack covers the link header and VLAN tags on top of the IP MTU
+	pcapLinkSlack = 64
+)
+
+func openPCAP(cfg InterfaceConfig) (PacketIO, error) {
+	t, err := NewPCAP(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
 func NewPCAP(cfg InterfaceConfig) (*PCAP, error) {
 	iface, dev := findDevInterface(cfg.Name)
 	slog.Info("Using interface",
@@ -16,22 +33,12 @@ func NewPCAP(cfg InterfaceConfig) (*PCAP, error) {
 		"device", dev.Name,
 		"mac", iface.HardwareAddr.String())
 
-	_, network, err := net.ParseCIDR(cfg.Network)
+	addrs, err := parseAddressing(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("parse cidr error: %w", err)
+		return nil, err
 	}
 
-	localIP := net.ParseIP(cfg.LocalIP)
-	if localIP == nil {
-		return nil, fmt.Errorf("invalid local IP: %s", cfg.LocalIP)
-	}
-
-	localIP = localIP.To4()
-	if !network.Contains(localIP) {
-		return nil, fmt.Errorf("local ip (%s) not in network (%s)", localIP, network)
-	}
-
-	inactive, err := createPcapHandle(dev)
+	inactive, err := createPcapHandle(dev, iface.MTU)
 	if err != nil {
 		return nil, fmt.Errorf("create pcap handle error: %w", err)
 	}
@@ -41,34 +48,56 @@ func NewPCAP(cfg InterfaceConfig) (*PCAP, error) {
 		return nil, fmt.Errorf("activate handle error: %w", err)
 	}
 
-	// Set BPF filter to capture ARP and IP traffic for our network
-	filter := fmt.Sprintf("arp or (src net %s or dst net %s)", network, network)
+	// Set BPF filter to capture ARP and IP traffic for our network, and DHCP clients without an address yet
+	filter := fmt.Sprintf("arp or (udp dst port 67) or (src net %s or dst net %s)", addrs.network, addrs.network)
+	if addrs.network6 != nil {
+		// Neighbor discovery runs over link-local addresses, so all ICMPv6 is needed
+		filter += fmt.Sprintf(" or icmp6 or (src net %s or dst net %s)", addrs.network6, addrs.network6)
+	}
+	if cfg.VLAN != 0 {
+		// Everything after the vlan primitive is matched inside the tag
+		filter = fmt.Sprintf("vlan %d and (%s)", cfg.VLAN, filter)
+	}
 	if err := handle.SetBPFFilter(filter); err != nil {
 		handle.Close()
 		return nil, fmt.Errorf("set BPF filter error: %w", err)
 	}
 
+	framing, err := NewFraming(handle.LinkType(), iface.HardwareAddr)
+	if err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("%s: %w", cfg.Name, err)
+	}
+	slog.Debug("Detected link type", "name", cfg.Name, "link_type", handle.LinkType())
+
+	// libpcap has no send timeout, the writer bounds how long a write to a link that
+	// doesn't drain holds up the bridge
+	writer := newAsyncWriter(handle.WritePacketData, iface.MTU+pcapLinkSlack, handle.Close)
+
 	return &PCAP{
 		name:      cfg.Name,
 		Interface: iface,
-		network:   network,
-		localIP:   localIP,
-		localMAC:  iface.HardwareAddr,
 		handle:    handle,
+		writer:    writer,
+		filter:    filter,
+		framing:   framing,
 	}, nil
 }
 
 type PCAP struct {
 	name      string
 	Interface net.Interface
-	network   *net.IPNet
-	localIP   net.IP
-	localMAC  net.HardwareAddr
 	handle    *pcap.Handle
-	readMux   sync.Mutex
+	// writer sends the frames, one at a time as libpcap doesn't promise a handle is safe to share
+	writer  *asyncWriter
+	filter  string
+	framing Framing
+	readMux sync.Mutex
+	// closed is guarded by readMux
+	closed bool
 }
 
-func createPcapHandle(dev pcap.Interface) (*pcap.InactiveHandle, error) {
+func createPcapHandle(dev pcap.Interface, mtu int) (*pcap.InactiveHandle, error) {
 	handle, err := pcap.NewInactiveHandle(dev.Name)
 	if err != nil {
 		return nil, fmt.Errorf("new inactive handle error: %w", err)
@@ -79,12 +108,12 @@ func createPcapHandle(dev pcap.Interface) (*pcap.InactiveHandle, error) {
 		return nil, fmt.Errorf("set promisc error: %w", err)
 	}
 
-	err = handle.SetSnapLen(1600)
+	err = handle.SetSnapLen(max(pcapSnapLen, mtu+pcapLinkSlack))
 	if err != nil {
 		return nil, fmt.Errorf("set snap len error: %w", err)
 	}
 
-	err = handle.SetTimeout(pcap.BlockForever)
+	err = handle.SetTimeout(readTimeout)
 	if err != nil {
 		return nil, fmt.Errorf("set timeout error: %w", err)
 	}
@@ -102,12 +131,18 @@ func createPcapHandle(dev pcap.Interface) (*pcap.InactiveHandle, error) {
 	return handle, nil
 }
 
+// Read returns a frame in libpcap's buffer, which the next read overwrites,
+// so it stays locked to the caller until Release
 func (t *PCAP) Read() []byte {
 	t.readMux.Lock()
-	defer t.readMux.Unlock()
+	if t.closed {
+		t.readMux.Unlock()
+		return nil
+	}
 	data, _, err := t.handle.ZeroCopyReadPacketData()
-	if err != nil {
-		if err != pcap.NextErrorTimeoutExpired {
+	if err != nil || len(data) == 0 {
+		t.readMux.Unlock()
+		if err != nil && err != pcap.NextErrorTimeoutExpired {
 			slog.Error("read packet error", "err", err)
 		}
 		return nil
@@ -115,17 +150,53 @@ func (t *PCAP) Read() []byte {
 	return data
 }
 
+func (t *PCAP) Release() {
+	t.readMux.Unlock()
+}
+
 func (t *PCAP) Write(p []byte) error {
-	err := t.handle.WritePacketData(p)
-	if err != nil {
+	if err := t.writer.Write(p); err != nil {
 		return fmt.Errorf("write packet error: %w", err)
 	}
 	return nil
 }
 
+// SetMACFilter narrows the capture to frames for mac and to broadcast and multicast
+func (t *PCAP) SetMACFilter(mac net.HardwareAddr) error {
+	filter := fmt.Sprintf("(ether dst %s or ether multicast) and (%s)", mac, t.filter)
+	if err := t.handle.SetBPFFilter(filter); err != nil {
+		return fmt.Errorf("set BPF filter error: %w", err)
+	}
+	return nil
+}
+
+func (t *PCAP) LinkType() layers.LinkType {
+	return t.handle.LinkType()
+}
+
+// Framing returns the codec for the link type of the capture handle
+func (t *PCAP) Framing() Framing {
+	return t.framing
+}
+
+func (t *PCAP) MTU() int {
+	return t.Interface.MTU
+}
+
+func (t *PCAP) MAC() net.HardwareAddr {
+	return t.Interface.HardwareAddr
+}
+
+// Close waits for the frame borrowed by a reader, which lives in libpcap's buffer, and
+// writeTimeout at most for a send in progress. The writer frees the handle after its last send.
 func (t *PCAP) Close() {
-	if t.handle != nil {
-		t.handle.Close()
+	t.readMux.Lock()
+	closed := t.closed
+	t.closed = true
+	t.readMux.Unlock()
+
+	if !closed {
+		t.writer.Close()
 	}
 }
 
@@ -0,0 +1,9 @@
+//go:build !cgo
+
+package internal
+
+import "errors"
+
+func openPCAP(cfg InterfaceConfig) (PacketIO, error) {
+	return nil, errors.New("pcap backend needs cgo and libpcap, use the afpacket backend")
+}
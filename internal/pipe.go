@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const pipeQueueSize = 256
+
+var (
+	errPipeClosed = errors.New("pipe closed")
+	errPipeFull   = errors.New("pipe full")
+)
+
+// Pipe is an in-memory PacketIO, frames written to one end are read from the other.
+// It lets the bridge run under go test without root or real interfaces.
+type Pipe struct {
+	rx    chan *[]byte
+	tx    chan *[]byte
+	done  chan struct{}
+	close *sync.Once
+	// frames holds the buffers of queued frames, shared by both ends
+	frames *sync.Pool
+
+	// read state, guarded by readMux
+	readMux sync.Mutex
+	held    *[]byte
+	timer   *time.Timer
+
+	linkType layers.LinkType
+	mtu      int
+	mac      net.HardwareAddr
+}
+
+// NewPipe returns both ends of a link with the given link type, MTU and MAC
+func NewPipe(linkType layers.LinkType, mtu int, mac net.HardwareAddr) (*Pipe, *Pipe) {
+	ab := make(chan *[]byte, pipeQueueSize)
+	ba := make(chan *[]byte, pipeQueueSize)
+	done := make(chan struct{})
+	once := &sync.Once{}
+	frames := &sync.Pool{New: func() any {
+		buf := make([]byte, 0, header.EthernetMinimumSize+vlanTagSize+mtu)
+		return &buf
+	}}
+
+	a := &Pipe{rx: ba, tx: ab, done: done, close: once, frames: frames, linkType: linkType, mtu: mtu, mac: mac}
+	b := &Pipe{rx: ab, tx: ba, done: done, close: once, frames: frames, linkType: linkType, mtu: mtu, mac: mac}
+	return a, b
+}
+
+func (p *Pipe) Read() []byte {
+	p.readMux.Lock()
+	if p.timer == nil {
+		p.timer = time.NewTimer(readTimeout)
+	} else {
+		p.timer.Reset(readTimeout)
+	}
+
+	select {
+	case buf := <-p.rx:
+		p.held = buf
+		return *buf
+	case <-p.done:
+	case <-p.timer.C:
+	}
+	p.readMux.Unlock()
+	return nil
+}
+
+// Release returns the buffer of the last frame read to the pool
+func (p *Pipe) Release() {
+	p.frames.Put(p.held)
+	p.held = nil
+	p.readMux.Unlock()
+}
+
+// Write queues a copy of frame for the peer. Like a NIC it drops the frame when the peer
+// doesn't keep up, so a stalled reader never blocks the bridge.
+func (p *Pipe) Write(frame []byte) error {
+	select {
+	case <-p.done:
+		return errPipeClosed
+	default:
+	}
+
+	// The caller may reuse its buffer, the peer gets its own copy
+	buf := p.frames.Get().(*[]byte)
+	*buf = append((*buf)[:0], frame...)
+
+	select {
+	case p.tx <- buf:
+		return nil
+	default:
+		p.frames.Put(buf)
+		return errPipeFull
+	}
+}
+
+// Close closes both ends of the pipe
+func (p *Pipe) Close() {
+	p.close.Do(func() { close(p.done) })
+}
+
+func (p *Pipe) LinkType() layers.LinkType { return p.linkType }
+func (p *Pipe) MTU() int                  { return p.mtu }
+func (p *Pipe) MAC() net.HardwareAddr     { return p.mac }
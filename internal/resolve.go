@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/DaniilSokolyuk/sing-vnet/arpr"
+	"github.com/DaniilSokolyuk/sing-vnet/ndpr"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+const (
+	// pendingPerDest bounds the packets held for one unresolved destination, the oldest is dropped first
+	pendingPerDest = 16
+	// pendingMaxDests bounds how many destinations are resolved at once
+	pendingMaxDests = 256
+	resolveRetries  = 3
+	resolveInterval = time.Second
+)
+
+// queuePending keeps a copy of packet until dst resolves, the first packet sends the solicitation
+func (b *Bridge) queuePending(dst netip.Addr, proto tcpip.NetworkProtocolNumber, packet []byte) {
+	b.mapMux.Lock()
+	e, ok := b.neighbors[dst]
+	if ok && e.state != neighborIncomplete {
+		// Resolved since the caller looked it up
+		mac := e.mac
+		b.mapMux.Unlock()
+		b.forwardL2(nil, mac, proto, packet)
+		return
+	}
+
+	if !ok {
+		if b.incomplete >= pendingMaxDests || !b.evictNeighborLocked() {
+			b.mapMux.Unlock()
+			return
+		}
+		e = &neighbor{ip: net.IP(dst.AsSlice()), state: neighborIncomplete, proto: proto, updated: time.Now(), probes: 1}
+		b.neighbors[dst] = e
+		b.incomplete++
+	}
+
+	if len(e.packets) == pendingPerDest {
+		copy(e.packets, e.packets[1:])
+		e.packets = e.packets[:pendingPerDest-1]
+	}
+	e.packets = append(e.packets, bytes.Clone(packet))
+	b.mapMux.Unlock()
+
+	if !ok {
+		b.solicit(e.ip)
+	}
+}
+
+// solicit asks the L2 side who has ip, with ARP or a neighbor solicitation
+func (b *Bridge) solicit(ip net.IP) {
+	var req []byte
+	var err error
+	if ip4 := ip.To4(); ip4 != nil {
+		req, err = arpr.SendRequest(ip4, b.localIP, b.localMAC)
+	} else {
+		req, err = ndpr.SendNeighborSolicit(ip, b.localIP6, b.localMAC)
+	}
+	if err != nil {
+		slog.Error("send neighbor solicitation error", "ip", ip, "err", err)
+		return
+	}
+
+	if err := b.from.Write(req); err != nil {
+		slog.Error("send neighbor solicitation error", "ip", ip, "err", err)
+	}
+}
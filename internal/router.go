@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// RouterConfig makes the gateway a routed hop instead of a transparent bridge
+type RouterConfig struct {
+	// Enabled decrements the TTL of forwarded packets and answers expired ones with
+	// ICMP time exceeded, so traceroute shows the gateway and routing loops die out
+	Enabled bool `json:"enabled"`
+}
+
+// RouterStats counts the packets router mode dropped
+type RouterStats struct {
+	Enabled bool `json:"enabled"`
+	// TTLExceeded are packets whose TTL or hop limit ran out at the gateway
+	TTLExceeded uint64 `json:"ttl_exceeded"`
+}
+
+// decrementTTL lowers the TTL or hop limit of the IP packet in place, fixing the IPv4
+// header checksum. It reports false when the packet expired and must be dropped.
+func decrementTTL(proto tcpip.NetworkProtocolNumber, packet []byte) bool {
+	switch proto {
+	case header.IPv4ProtocolNumber:
+		ip := header.IPv4(packet)
+		ttl := ip.TTL()
+		if ttl <= 1 {
+			return false
+		}
+		// TTL shares a 16-bit word with the protocol
+		old := binary.BigEndian.Uint16(packet[8:])
+		ip.SetTTL(ttl - 1)
+		ip.SetChecksum(checksumUpdate(ip.Checksum(), old, binary.BigEndian.Uint16(packet[8:]), false))
+	case header.IPv6ProtocolNumber:
+		ip := header.IPv6(packet)
+		hop := ip.HopLimit()
+		if hop <= 1 {
+			return false
+		}
+		ip.SetHopLimit(hop - 1)
+	}
+	return true
+}
+
+// routeL3 applies router mode to a packet from the L2 side, the sender is told from
+// the gateway address when it expired. It reports whether the packet may be forwarded.
+func (b *Bridge) routeL3(frame []byte, off int, proto tcpip.NetworkProtocolNumber) bool {
+	if !b.router || decrementTTL(proto, frame[off:]) {
+		return true
+	}
+
+	b.ttlExceeded.Add(1)
+	reply, err := b.icmpError(proto, frame[off:], icmpTimeExceeded, 0)
+	if err != nil {
+		slog.Error("build icmp time exceeded error", "err", err)
+		return false
+	}
+	if reply != nil {
+		b.writeL2(net.HardwareAddr(frame[6:12]), proto, reply)
+	}
+	return false
+}
+
+// routeL2 is routeL3 for a packet from the TUN, the time exceeded error goes back into the TUN
+func (b *Bridge) routeL2(proto tcpip.NetworkProtocolNumber, packet []byte) bool {
+	if !b.router || decrementTTL(proto, packet) {
+		return true
+	}
+
+	b.ttlExceeded.Add(1)
+	reply, err := b.icmpError(proto, packet, icmpTimeExceeded, 0)
+	if err != nil {
+		slog.Error("build icmp time exceeded error", "err", err)
+		return false
+	}
+	if reply == nil {
+		return false
+	}
+	if err := b.writeL3(reply, 0, proto); err != nil {
+		slog.Error("send icmp time exceeded error", "err", err)
+	}
+	return false
+}
+
+// RouterStats returns the router mode counters
+func (b *Bridge) RouterStats() RouterStats {
+	return RouterStats{Enabled: b.router, TTLExceeded: b.ttlExceeded.Load()}
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestDecrementTTL(t *testing.T) {
+	for _, tc := range []struct {
+		ttl     uint8
+		ipv6    bool
+		forward bool
+	}{
+		{ttl: 64, forward: true},
+		{ttl: 2, forward: true},
+		{ttl: 1},
+		{ttl: 0},
+		{ttl: 64, ipv6: true, forward: true},
+		{ttl: 1, ipv6: true},
+	} {
+		if tc.ipv6 {
+			ip := &layers.IPv6{Version: 6, HopLimit: tc.ttl, NextHeader: layers.IPProtocolNoNextHeader, SrcIP: net.ParseIP("fd00::2"), DstIP: net.ParseIP("2001:db8::1")}
+			packet := serialize(t, ip)
+			if got := decrementTTL(header.IPv6ProtocolNumber, packet); got != tc.forward {
+				t.Fatalf("hop limit %d: forward %v", tc.ttl, got)
+			}
+			if tc.forward && header.IPv6(packet).HopLimit() != tc.ttl-1 {
+				t.Fatalf("hop limit %d became %d", tc.ttl, header.IPv6(packet).HopLimit())
+			}
+			continue
+		}
+
+		l := udpLayers(testClientIP, testRemoteIP, "query")
+		l[0].(*layers.IPv4).TTL = tc.ttl
+		packet := serialize(t, l...)
+		if got := decrementTTL(header.IPv4ProtocolNumber, packet); got != tc.forward {
+			t.Fatalf("ttl %d: forward %v", tc.ttl, got)
+		}
+		ip := header.IPv4(packet)
+		if tc.forward && ip.TTL() != tc.ttl-1 {
+			t.Fatalf("ttl %d became %d", tc.ttl, ip.TTL())
+		}
+		if ip.CalculateChecksum() != 0xffff {
+			t.Fatalf("ttl %d: header checksum broken", tc.ttl)
+		}
+	}
+}
+
+// ttlUDP is udpLayers with the TTL given
+func ttlUDP(src, dst net.IP, payload string, ttl uint8) []gopacket.SerializableLayer {
+	l := udpLayers(src, dst, payload)
+	l[0].(*layers.IPv4).TTL = ttl
+	return l
+}
+
+// hasTTL matches isUDP packets with the TTL and a valid header checksum
+func hasTTL(src, dst net.IP, payload string, ttl uint8) func(gopacket.Packet) bool {
+	return func(p gopacket.Packet) bool {
+		ip, _ := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		return isUDP(src, dst, payload)(p) && ip.TTL == ttl && header.IPv4(ip.Contents).CalculateChecksum() == 0xffff
+	}
+}
+
+// isTimeExceeded matches the ICMP time exceeded from the gateway to dst
+func isTimeExceeded(dst net.IP) func(gopacket.Packet) bool {
+	return func(p gopacket.Packet) bool {
+		ip, ok := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		icmp, _ := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+		return ok && icmp != nil && ip.SrcIP.Equal(testGatewayIP) && ip.DstIP.Equal(dst) &&
+			icmp.TypeCode == layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded)
+	}
+}
+
+func TestRouterMode(t *testing.T) {
+	for _, router := range []bool{false, true} {
+		name := "off"
+		if router {
+			name = "on"
+		}
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Router.Enabled = router
+			b, lan, tun := startTestBridge(t, cfg)
+			eth := &layers.Ethernet{SrcMAC: testClientMAC, DstMAC: testNICMAC, EthernetType: layers.EthernetTypeIPv4}
+
+			// L2 to L3, which also teaches the bridge the client's MAC
+			want := uint8(64)
+			if router {
+				want = 63
+			}
+			lan.Write(serialize(t, append([]gopacket.SerializableLayer{eth}, ttlUDP(testClientIP, testRemoteIP, "query", 64)...)...))
+			expect(t, tun, layers.LayerTypeIPv4, hasTTL(testClientIP, testRemoteIP, "query", want))
+
+			tun.Write(serialize(t, ttlUDP(testRemoteIP, testClientIP, "answer", 64)...))
+			expect(t, lan, layers.LayerTypeEthernet, hasTTL(testRemoteIP, testClientIP, "answer", want))
+
+			// Packets about to expire
+			lan.Write(serialize(t, append([]gopacket.SerializableLayer{eth}, ttlUDP(testClientIP, testRemoteIP, "expired", 1)...)...))
+			tun.Write(serialize(t, ttlUDP(testRemoteIP, testClientIP, "expired", 1)...))
+			if !router {
+				expect(t, tun, layers.LayerTypeIPv4, hasTTL(testClientIP, testRemoteIP, "expired", 1))
+				expect(t, lan, layers.LayerTypeEthernet, hasTTL(testRemoteIP, testClientIP, "expired", 1))
+				if st := b.RouterStats(); st.Enabled || st.TTLExceeded != 0 {
+					t.Fatalf("router stats %+v", st)
+				}
+				return
+			}
+
+			packet := expect(t, lan, layers.LayerTypeEthernet, isTimeExceeded(testClientIP))
+			if eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); eth.DstMAC.String() != testClientMAC.String() {
+				t.Fatalf("time exceeded sent to %s", eth.DstMAC)
+			}
+			expect(t, tun, layers.LayerTypeIPv4, isTimeExceeded(testRemoteIP))
+			if st := b.RouterStats(); !st.Enabled || st.TTLExceeded != 2 {
+				t.Fatalf("router stats %+v, want 2 exceeded", st)
+			}
+		})
+	}
+}
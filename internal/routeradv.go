@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/DaniilSokolyuk/sing-vnet/ndpr"
+)
+
+const (
+	defaultRALifetime = 30 * time.Minute
+	defaultRAInterval = 200 * time.Second
+	// minRADelay limits how often a router solicitation triggers an advertisement (RFC 4861 MIN_DELAY_BETWEEN_RAS)
+	minRADelay = 3 * time.Second
+)
+
+func (b *Bridge) setupRouterAdvert(cfg RouterAdvertConfig) error {
+	if b.network6 == nil {
+		return fmt.Errorf("router advertisements need an IPv6 network")
+	}
+
+	ra := &ndpr.RouterAdvert{
+		Prefix:   b.network6,
+		Lifetime: time.Duration(cfg.Lifetime),
+	}
+	if ra.Lifetime == 0 {
+		ra.Lifetime = defaultRALifetime
+	}
+
+	if cfg.Prefix != "" {
+		_, prefix, err := net.ParseCIDR(cfg.Prefix)
+		if err != nil {
+			return fmt.Errorf("parse prefix error: %w", err)
+		}
+		ra.Prefix = prefix
+	}
+
+	if ones, bits := ra.Prefix.Mask.Size(); ones != 64 || bits != 128 {
+		slog.Warn("SLAAC requires a /64 prefix, devices will not autoconfigure", "prefix", ra.Prefix)
+	}
+
+	for _, s := range cfg.RDNSS {
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid rdnss address: %s", s)
+		}
+		ra.RDNSS = append(ra.RDNSS, ip)
+	}
+	if len(cfg.RDNSS) == 0 {
+		ra.RDNSS = []net.IP{b.localIP6}
+	}
+
+	b.ra = ra
+	b.raEvery = time.Duration(cfg.Interval)
+	if b.raEvery == 0 {
+		b.raEvery = defaultRAInterval
+	}
+
+	return nil
+}
+
+// advertiseRouter periodically sends unsolicited router advertisements until ctx is done
+func (b *Bridge) advertiseRouter(ctx context.Context) {
+	ticker := time.NewTicker(b.raEvery)
+	defer ticker.Stop()
+
+	for {
+		b.sendRouterAdvert(*b.ra)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// solicitedRouterAdvert answers a router solicitation, rate limited to one per minRADelay
+func (b *Bridge) solicitedRouterAdvert() {
+	if b.ra == nil {
+		return
+	}
+
+	b.raSolMux.Lock()
+	if time.Since(b.raSolAt) < minRADelay {
+		b.raSolMux.Unlock()
+		return
+	}
+	b.raSolAt = time.Now()
+	b.raSolMux.Unlock()
+
+	b.sendRouterAdvert(*b.ra)
+}
+
+// withdrawRouter advertises a zero lifetime so devices fail back to the real router
+func (b *Bridge) withdrawRouter() {
+	if b.ra == nil {
+		return
+	}
+
+	ra := *b.ra
+	ra.Lifetime = 0
+	b.sendRouterAdvert(ra)
+}
+
+func (b *Bridge) sendRouterAdvert(ra ndpr.RouterAdvert) {
+	packet, err := ndpr.SendRouterAdvert(ra, b.localMAC)
+	if err != nil {
+		slog.Error("build router advert error", "err", err)
+		return
+	}
+
+	if err := b.from.Write(packet); err != nil {
+		slog.Error("send router advert error", "err", err)
+	}
+}
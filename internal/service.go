@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
 	"time"
 
@@ -25,36 +27,39 @@ func (a *App) StartSingBox() (err error) {
 
 	time.Sleep(5 * time.Second)
 
-	cfg := Config{
-		FromInterface: InterfaceConfig{
-			Name:    "en0",
-			Network: "172.26.0.0/16",
-			LocalIP: "172.26.0.1",
-		},
-		ToInterface: InterfaceConfig{
-			Name:    "utun128",
-			Network: "172.26.0.0/16",
-			LocalIP: "172.26.0.1",
-		},
-	}
+	a.Cfg.checkInbounds()
 
-	a.Bridge, err = Start(a.Ctx, cfg)
-	if err != nil {
-		slog.Error("Failed to start bridge", "error", err)
-		return
+	// A segment that fails to start doesn't stop the others
+	var errs []error
+	for _, cfg := range a.Cfg.Bridges {
+		b, err := Open(a.Ctx, cfg)
+		if err != nil {
+			slog.Error("Failed to start bridge", "bridge", cfg.Name, "error", err)
+			errs = append(errs, fmt.Errorf("bridge %s: %w", cfg.Name, err))
+			continue
+		}
+		a.Bridges = append(a.Bridges, b)
 	}
+	a.Err = errors.Join(errs...)
 
-	return nil
+	return a.Err
 }
 
 func (a *App) StopSingBox() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	if a.Process == nil {
 		slog.Warn("SingBox is not running")
 		return
 	}
 
-	a.Bridge.Close()
-	a.Bridge = nil
+	// Closing the bridge withdraws the IPv6 router advertisement
+	for _, b := range a.Bridges {
+		b.Close()
+	}
+	a.Bridges = nil
+	a.Err = nil
 
 	err := a.Process.Stop()
 	if err != nil {
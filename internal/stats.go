@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statsInterval = time.Second
+	// statsIdle is how long a client without traffic keeps its counters
+	statsIdle = 24 * time.Hour
+	// statsMaxClients bounds the clients counted at once, like the neighbor cache
+	statsMaxClients = 1024
+)
+
+// ClientStats is the traffic of one LAN device, tx is what it sent into the TUN and rx what it got back
+type ClientStats struct {
+	MAC       string    `json:"mac"`
+	IPs       []string  `json:"ips"`
+	TxBytes   uint64    `json:"tx_bytes"`
+	TxPackets uint64    `json:"tx_packets"`
+	RxBytes   uint64    `json:"rx_bytes"`
+	RxPackets uint64    `json:"rx_packets"`
+	TxRate    float64   `json:"tx_rate"` // bytes per second
+	RxRate    float64   `json:"rx_rate"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// clientCounters are updated with atomics so the forwarding loops only take a read lock
+type clientCounters struct {
+	txBytes, txPackets atomic.Uint64
+	rxBytes, rxPackets atomic.Uint64
+	lastSeen           atomic.Int64
+	firstSeen          time.Time
+
+	// rates are float64 bits written by sampleStats, prev* are only touched there
+	txRate, rxRate atomic.Uint64
+	prevTx, prevRx uint64
+}
+
+type trafficStats struct {
+	mu      sync.RWMutex
+	clients map[[6]byte]*clientCounters
+}
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{clients: make(map[[6]byte]*clientCounters)}
+}
+
+// account adds a packet of n bytes sent (tx) or received by the client with mac
+func (s *trafficStats) account(mac []byte, n int, tx bool) {
+	key := [6]byte(mac)
+
+	s.mu.RLock()
+	c, ok := s.clients[key]
+	s.mu.RUnlock()
+
+	now := time.Now()
+	if !ok {
+		s.mu.Lock()
+		if c, ok = s.clients[key]; !ok {
+			s.evictLocked()
+			c = &clientCounters{firstSeen: now}
+			s.clients[key] = c
+		}
+		s.mu.Unlock()
+	}
+
+	if tx {
+		c.txBytes.Add(uint64(n))
+		c.txPackets.Add(1)
+	} else {
+		c.rxBytes.Add(uint64(n))
+		c.rxPackets.Add(1)
+	}
+	c.lastSeen.Store(now.UnixNano())
+}
+
+// evictLocked makes room for one client, forgetting the one idle the longest, so spoofed
+// source MACs can't grow the map without bound
+func (s *trafficStats) evictLocked() {
+	if len(s.clients) < statsMaxClients {
+		return
+	}
+
+	var oldest [6]byte
+	oldestSeen := int64(math.MaxInt64)
+	for key, c := range s.clients {
+		if seen := c.lastSeen.Load(); seen < oldestSeen {
+			oldest, oldestSeen = key, seen
+		}
+	}
+	delete(s.clients, oldest)
+}
+
+// sampleStats updates the rates of every client and forgets idle ones until ctx is done
+func (s *trafficStats) sampleStats(ctx context.Context) {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.sample(now, now.Sub(last))
+			last = now
+		}
+	}
+}
+
+func (s *trafficStats) sample(now time.Time, elapsed time.Duration) {
+	idle := now.Add(-statsIdle).UnixNano()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, c := range s.clients {
+		if c.lastSeen.Load() < idle {
+			delete(s.clients, key)
+			continue
+		}
+
+		tx, rx := c.txBytes.Load(), c.rxBytes.Load()
+		c.txRate.Store(math.Float64bits(float64(tx-c.prevTx) / elapsed.Seconds()))
+		c.rxRate.Store(math.Float64bits(float64(rx-c.prevRx) / elapsed.Seconds()))
+		c.prevTx, c.prevRx = tx, rx
+	}
+}
+
+func (s *trafficStats) snapshot() []ClientStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]ClientStats, 0, len(s.clients))
+	for key, c := range s.clients {
+		list = append(list, ClientStats{
+			MAC:       net.HardwareAddr(key[:]).String(),
+			TxBytes:   c.txBytes.Load(),
+			TxPackets: c.txPackets.Load(),
+			RxBytes:   c.rxBytes.Load(),
+			RxPackets: c.rxPackets.Load(),
+			TxRate:    math.Float64frombits(c.txRate.Load()),
+			RxRate:    math.Float64frombits(c.rxRate.Load()),
+			FirstSeen: c.firstSeen,
+			LastSeen:  time.Unix(0, c.lastSeen.Load()),
+		})
+	}
+	return list
+}
+
+// Stats returns the traffic of every client seen recently, busiest first, with the IPs
+// the neighbor cache knows for it
+func (b *Bridge) Stats() []ClientStats {
+	list := b.stats.snapshot()
+
+	ips := make(map[string][]string)
+	for _, n := range b.Neighbors() {
+		ips[n.MAC] = append(ips[n.MAC], n.IP)
+	}
+
+	for i := range list {
+		list[i].IPs = ips[list[i].MAC]
+	}
+
+	slices.SortFunc(list, func(x, y ClientStats) int {
+		if c := cmp.Compare(y.TxBytes+y.RxBytes, x.TxBytes+x.RxBytes); c != 0 {
+			return c
+		}
+		return strings.Compare(x.MAC, y.MAC)
+	})
+	return list
+}
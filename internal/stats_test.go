@@ -0,0 +1,24 @@
+package internal
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestStatsEvictOldestClient(t *testing.T) {
+	s := newTrafficStats()
+
+	mac := make([]byte, 6)
+	for i := range statsMaxClients + 10 {
+		binary.BigEndian.PutUint32(mac[2:], uint32(i))
+		s.account(mac, 100, true)
+	}
+
+	if n := len(s.clients); n != statsMaxClients {
+		t.Fatalf("%d clients counted, want %d", n, statsMaxClients)
+	}
+	binary.BigEndian.PutUint32(mac[2:], uint32(statsMaxClients+9))
+	if _, ok := s.clients[[6]byte(mac)]; !ok {
+		t.Fatal("newest client was evicted")
+	}
+}
@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/gopacket/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	etherTypeVLAN = 0x8100
+	vlanTagSize   = 4
+	vlanMax       = 4094
+)
+
+// vlanIO puts the L2 side of a bridge on an 802.1Q VLAN. Reads drop frames of other VLANs
+// and untagged ones and strip the tag, writes insert it.
+type vlanIO struct {
+	PacketIO
+	vid    uint16
+	frames sync.Pool
+	// batches holds the vlanBatch scratch of WriteBatch, workers may write at the same time
+	batches sync.Pool
+}
+
+// vlanBatch is the tagged copies of a batch and the pooled buffers they live in
+type vlanBatch struct {
+	tagged [][]byte
+	bufs   []*[]byte
+}
+
+func newVLAN(io PacketIO, vid int) (PacketIO, error) {
+	if vid < 1 || vid > vlanMax {
+		return nil, fmt.Errorf("vlan %d out of range 1-%d", vid, vlanMax)
+	}
+	if lt := io.LinkType(); lt != layers.LinkTypeEthernet {
+		return nil, fmt.Errorf("vlan needs an ethernet interface, got %s", lt)
+	}
+	v := &vlanIO{PacketIO: io, vid: uint16(vid)}
+	v.frames.New = func() any {
+		buf := make([]byte, 0, header.EthernetMinimumSize+vlanTagSize+io.MTU())
+		return &buf
+	}
+	v.batches.New = func() any {
+		return new(vlanBatch)
+	}
+	return v, nil
+}
+
+// Read returns the next frame of the VLAN without its tag, nil for frames of other VLANs
+func (v *vlanIO) Read() []byte {
+	frame := v.PacketIO.Read()
+	if frame == nil {
+		return nil
+	}
+
+	frame = v.untag(frame)
+	if frame == nil {
+		v.PacketIO.Release()
+	}
+	return frame
+}
+
+// ReadBatch is Read for a batch, the frames of other VLANs are left out
+func (v *vlanIO) ReadBatch(frames [][]byte) int {
+	n := readBatch(v.PacketIO, frames)
+	if n == 0 {
+		return 0
+	}
+
+	kept := 0
+	for _, frame := range frames[:n] {
+		if frame = v.untag(frame); frame != nil {
+			frames[kept] = frame
+			kept++
+		}
+	}
+	if kept == 0 {
+		v.PacketIO.Release()
+	}
+	return kept
+}
+
+// untag strips the tag of a frame of the VLAN, it returns nil for other frames
+func (v *vlanIO) untag(frame []byte) []byte {
+	if len(frame) < header.EthernetMinimumSize+vlanTagSize ||
+		binary.BigEndian.Uint16(frame[12:]) != etherTypeVLAN ||
+		binary.BigEndian.Uint16(frame[14:])&0x0fff != v.vid {
+		return nil
+	}
+
+	// Slide the addresses over the tag, the frame is borrowed and ours to change
+	copy(frame[vlanTagSize:], frame[:12])
+	return frame[vlanTagSize:]
+}
+
+func (v *vlanIO) Write(p []byte) error {
+	buf, err := v.tag(p)
+	if err != nil {
+		return err
+	}
+	defer v.frames.Put(buf)
+	return v.PacketIO.Write(*buf)
+}
+
+// WriteBatch tags every frame and writes them as one batch
+func (v *vlanIO) WriteBatch(frames [][]byte) error {
+	batch := v.batches.Get().(*vlanBatch)
+	defer func() {
+		for _, buf := range batch.bufs {
+			v.frames.Put(buf)
+		}
+		clear(batch.bufs)
+		clear(batch.tagged)
+		batch.bufs = batch.bufs[:0]
+		batch.tagged = batch.tagged[:0]
+		v.batches.Put(batch)
+	}()
+
+	for _, p := range frames {
+		buf, err := v.tag(p)
+		if err != nil {
+			return err
+		}
+		batch.bufs = append(batch.bufs, buf)
+		batch.tagged = append(batch.tagged, *buf)
+	}
+	return writeBatch(v.PacketIO, batch.tagged)
+}
+
+// tag returns a pooled copy of frame with the VLAN tag inserted
+func (v *vlanIO) tag(p []byte) (*[]byte, error) {
+	if len(p) < header.EthernetMinimumSize {
+		return nil, fmt.Errorf("short frame of %d bytes", len(p))
+	}
+
+	buf := v.frames.Get().(*[]byte)
+	frame := append((*buf)[:0], p[:12]...)
+	frame = binary.BigEndian.AppendUint16(frame, etherTypeVLAN)
+	frame = binary.BigEndian.AppendUint16(frame, v.vid)
+	frame = append(frame, p[12:]...)
+	*buf = frame
+	return buf, nil
+}
+
+// OpenQueue opens a queue of the backend on the same VLAN
+func (v *vlanIO) OpenQueue() (PacketIO, error) {
+	q, ok := v.PacketIO.(Queues)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+
+	io, err := q.OpenQueue()
+	if err != nil {
+		return nil, err
+	}
+	tagged, err := newVLAN(io, int(v.vid))
+	if err != nil {
+		io.Close()
+		return nil, err
+	}
+	return tagged, nil
+}
+
+// SetMACFilter passes the gateway MAC to the backend, the tag comes after the addresses
+func (v *vlanIO) SetMACFilter(mac net.HardwareAddr) error {
+	if f, ok := v.PacketIO.(MACFilter); ok {
+		return f.SetMACFilter(mac)
+	}
+	return nil
+}
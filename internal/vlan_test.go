@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+const testVLAN = 100
+
+// tagged returns frame with an 802.1Q tag for vid
+func tagged(frame []byte, vid uint16) []byte {
+	out := append([]byte(nil), frame[:12]...)
+	out = binary.BigEndian.AppendUint16(out, etherTypeVLAN)
+	out = binary.BigEndian.AppendUint16(out, vid)
+	return append(out, frame[12:]...)
+}
+
+func newTestVLAN(t *testing.T) (v PacketIO, peer *Pipe) {
+	t.Helper()
+
+	p, peer := NewPipe(layers.LinkTypeEthernet, 1500, testNICMAC)
+	v, err := newVLAN(p, testVLAN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(v.Close)
+	return v, peer
+}
+
+func TestVLANWrite(t *testing.T) {
+	v, peer := newTestVLAN(t)
+
+	frames := [][]byte{
+		udpFrame(t, testNICMAC, testClientMAC, testRemoteIP, testClientIP, "one"),
+		udpFrame(t, testNICMAC, testPeerMAC, testRemoteIP, testPeerIP, "two"),
+	}
+	if err := v.Write(frames[0]); err != nil {
+		t.Fatal(err)
+	}
+	// Batches run twice so the second reuses the scratch slices of the first
+	for range 2 {
+		if err := v.(BatchWriter).WriteBatch(frames); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range [][]byte{frames[0], frames[0], frames[1], frames[0], frames[1]} {
+		got := peer.Read()
+		if !bytes.Equal(got, tagged(want, testVLAN)) {
+			t.Fatalf("frame %d is %x, want it tagged", i, got)
+		}
+		peer.Release()
+	}
+
+	if err := v.(BatchWriter).WriteBatch([][]byte{frames[0], {1, 2, 3}}); err == nil {
+		t.Fatal("short frame tagged")
+	}
+}
+
+func TestVLANRead(t *testing.T) {
+	v, peer := newTestVLAN(t)
+	frame := udpFrame(t, testClientMAC, testNICMAC, testClientIP, testRemoteIP, "query")
+
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		keep bool
+	}{
+		{name: "tagged", in: tagged(frame, testVLAN), keep: true},
+		{name: "priority bits", in: tagged(frame, 5<<13|testVLAN), keep: true},
+		{name: "other vlan", in: tagged(frame, testVLAN+1)},
+		{name: "untagged", in: frame},
+		{name: "short", in: tagged(frame, testVLAN)[:16]},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			peer.Write(tc.in)
+			got := v.Read()
+			if !tc.keep {
+				if got != nil {
+					t.Fatalf("read %x", got)
+				}
+				return
+			}
+			if !bytes.Equal(got, frame) {
+				t.Fatalf("read %x, want %x", got, frame)
+			}
+			v.Release()
+		})
+	}
+
+	// A batch keeps the frames of the VLAN only
+	frames := make([][]byte, 4)
+	peer.Write(tagged(frame, testVLAN+1))
+	if n := v.(BatchReader).ReadBatch(frames); n != 0 {
+		t.Fatalf("batch of another vlan kept %d frames", n)
+	}
+	peer.Write(tagged(frame, testVLAN))
+	if n := v.(BatchReader).ReadBatch(frames); n != 1 || !bytes.Equal(frames[0], frame) {
+		t.Fatalf("batch kept %d frames", n)
+	}
+	v.Release()
+}
+
+func TestVLANWriteBatchNoAlloc(t *testing.T) {
+	v, peer := newTestVLAN(t)
+	frames := [][]byte{udpFrame(t, testNICMAC, testClientMAC, testRemoteIP, testClientIP, "one")}
+	frames = append(frames, frames[0])
+
+	allocs := testing.AllocsPerRun(100, func() {
+		v.(BatchWriter).WriteBatch(frames)
+		for range frames {
+			peer.Read()
+			peer.Release()
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("%v allocations per batch", allocs)
+	}
+}
+
+func TestVLANBridge(t *testing.T) {
+	from, lan := NewPipe(layers.LinkTypeEthernet, 1500, testNICMAC)
+	to, _ := NewPipe(layers.LinkTypeRaw, 1500, nil)
+	tagging, err := newVLAN(from, testVLAN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Start(context.Background(), testConfig(), tagging, to)
+	if err != nil {
+		t.Fatalf("start bridge: %v", err)
+	}
+	t.Cleanup(b.Close)
+
+	lan.Write(tagged(arpFrame(t, layers.ARPRequest, testClientMAC, testClientIP, testGatewayIP, nil), testVLAN))
+
+	// Decoding from ethernet goes through the Dot1Q layer
+	packet := expect(t, lan, layers.LayerTypeEthernet, func(p gopacket.Packet) bool {
+		arp, ok := p.Layer(layers.LayerTypeARP).(*layers.ARP)
+		return ok && arp.Operation == layers.ARPReply && bytes.Equal(arp.DstHwAddress, testClientMAC)
+	})
+	if tag, ok := packet.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q); !ok || tag.VLANIdentifier != testVLAN {
+		t.Fatalf("reply not on vlan %d", testVLAN)
+	}
+}
@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// flowQueueSize is how many frames wait for a worker fed by a shared reader
+const flowQueueSize = 256
+
+// FNV-1a, see flowHash
+const (
+	fnvOffset = 2166136261
+	fnvPrime  = 16777619
+)
+
+// lane is one direction through the bridge, read from in and written to out
+type lane struct {
+	in  []PacketIO
+	out []PacketIO
+	// pool holds the buffers of frames handle builds for out, nil when they point into the read batch
+	pool   *sync.Pool
+	flow   func(packet []byte) uint32
+	handle func(tx *txBatch, packet []byte)
+}
+
+// openQueues returns io and n-1 more queues of it, or only io when the backend can't
+// open queues and the workers share one reader
+func openQueues(io PacketIO, n int) []PacketIO {
+	queues := []PacketIO{io}
+	if n <= 1 {
+		return queues
+	}
+
+	q, ok := io.(Queues)
+	if !ok {
+		return queues
+	}
+	for len(queues) < n {
+		queue, err := q.OpenQueue()
+		if err != nil {
+			if errors.Is(err, errors.ErrUnsupported) {
+				slog.Debug("Workers share one reader", "err", err)
+			} else {
+				slog.Warn("open queue error, workers share one reader", "err", err)
+			}
+			for _, queue := range queues[1:] {
+				queue.Close()
+			}
+			return queues[:1]
+		}
+		queues = append(queues, queue)
+	}
+	return queues
+}
+
+// runLane forwards a lane with n workers. With a queue per worker the kernel already split
+// the flows and each worker reads its own, otherwise one reader hands the frames to the
+// workers by flow hash. Either way the packets of a flow stay in order.
+func (b *Bridge) runLane(ctx context.Context, l lane, n int) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	defer wg.Wait()
+
+	if len(l.in) >= n {
+		for i := range n {
+			go func() {
+				defer wg.Done()
+				b.readLoop(ctx, l.in[i], l.tx(b.batchSize, i), l.handle)
+			}()
+		}
+		return
+	}
+
+	workers := make([]chan *[]byte, n)
+	for i := range workers {
+		workers[i] = make(chan *[]byte, flowQueueSize)
+		go func() {
+			defer wg.Done()
+			b.workLoop(ctx, workers[i], l.tx(b.batchSize, i), l.handle)
+		}()
+	}
+	b.shardLoop(ctx, l.in[0], workers, l.flow)
+}
+
+// tx returns the write batch of worker i, the workers are spread over the queues of out
+func (l lane) tx(size, i int) *txBatch {
+	return newTxBatch(l.out[i%len(l.out)], size, l.pool)
+}
+
+// readLoop forwards the frames of one queue
+func (b *Bridge) readLoop(ctx context.Context, in PacketIO, tx *txBatch, handle func(*txBatch, []byte)) {
+	frames := make([][]byte, b.batchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			n := readBatch(in, frames)
+			if n == 0 {
+				continue
+			}
+			for _, packet := range frames[:n] {
+				handle(tx, packet)
+			}
+			// Frames in tx may point into the read batch, so they go out before it is released
+			tx.flush()
+			in.Release()
+		}
+	}
+}
+
+// shardLoop reads in and hands copies of the frames to the workers by flow hash
+func (b *Bridge) shardLoop(ctx context.Context, in PacketIO, workers []chan *[]byte, flow func([]byte) uint32) {
+	frames := make([][]byte, b.batchSize)
+	for ctx.Err() == nil {
+		n := readBatch(in, frames)
+		if n == 0 {
+			continue
+		}
+		for _, frame := range frames[:n] {
+			buf := b.frames.Get().(*[]byte)
+			*buf = append((*buf)[:0], frame...)
+			select {
+			case workers[flow(frame)%uint32(len(workers))] <- buf:
+			case <-ctx.Done():
+				b.frames.Put(buf)
+			}
+		}
+		in.Release()
+	}
+}
+
+// workLoop forwards the frames shardLoop hands to one worker, what is queued is taken as a batch
+func (b *Bridge) workLoop(ctx context.Context, queue <-chan *[]byte, tx *txBatch, handle func(*txBatch, []byte)) {
+	held := make([]*[]byte, 0, b.batchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case buf := <-queue:
+			held = append(held, buf)
+		}
+
+	batch:
+		for len(held) < cap(held) {
+			select {
+			case buf := <-queue:
+				held = append(held, buf)
+			default:
+				break batch
+			}
+		}
+
+		for _, buf := range held {
+			handle(tx, *buf)
+		}
+		tx.flush()
+		for _, buf := range held {
+			b.frames.Put(buf)
+		}
+		clear(held)
+		held = held[:0]
+	}
+}
+
+// flowL2 is the flow hash of a frame from the L2 side
+func flowL2(frame []byte) uint32 {
+	if len(frame) < header.EthernetMinimumSize {
+		return 0
+	}
+	return flowHash(header.Ethernet(frame).Type(), frame[header.EthernetMinimumSize:])
+}
+
+// flowL3 is the flow hash of a packet from the TUN
+func (b *Bridge) flowL3(packet []byte) uint32 {
+	proto, ip, ok := b.tunFraming.Decode(packet)
+	if !ok {
+		return 0
+	}
+	return flowHash(proto, ip)
+}
+
+// flowHash hashes the addresses, transport protocol and ports of an IP packet, so every packet
+// of a flow lands on the same worker. Fragments hash without ports, they have none after the
+// first one. Anything else hashes to 0.
+func flowHash(proto tcpip.NetworkProtocolNumber, packet []byte) uint32 {
+	var addrs, ports []byte
+	var transport tcpip.TransportProtocolNumber
+	switch proto {
+	case header.IPv4ProtocolNumber:
+		if len(packet) < header.IPv4MinimumSize {
+			return 0
+		}
+		ip := header.IPv4(packet)
+		addrs = packet[12:20]
+		transport = ip.TransportProtocol()
+		hl := int(ip.HeaderLength())
+		if !ip.More() && ip.FragmentOffset() == 0 && len(packet) >= hl+4 {
+			ports = packet[hl : hl+4]
+		}
+	case header.IPv6ProtocolNumber:
+		if len(packet) < header.IPv6MinimumSize {
+			return 0
+		}
+		// Extension headers, fragments among them, hash by address
+		addrs = packet[8:header.IPv6MinimumSize]
+		transport = header.IPv6(packet).TransportProtocol()
+		if len(packet) >= header.IPv6MinimumSize+4 {
+			ports = packet[header.IPv6MinimumSize : header.IPv6MinimumSize+4]
+		}
+	default:
+		return 0
+	}
+	if transport != header.TCPProtocolNumber && transport != header.UDPProtocolNumber {
+		ports = nil
+	}
+
+	h := uint32(fnvOffset)
+	for _, b := range addrs {
+		h = (h ^ uint32(b)) * fnvPrime
+	}
+	h = (h ^ uint32(transport)) * fnvPrime
+	for _, b := range ports {
+		h = (h ^ uint32(b)) * fnvPrime
+	}
+	return h
+}
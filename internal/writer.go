@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var (
+	errWriteTimeout = errors.New("write timed out")
+	errWriteStalled = errors.New("link stalled, an earlier write is still blocked")
+	errWriterClosed = errors.New("writer closed")
+)
+
+// asyncWriter sends frames from a goroutine of its own, for backends such as libpcap whose
+// send can't be given a timeout. A caller waits writeTimeout at most, a send that doesn't
+// return by then is left behind and later frames are dropped until it does.
+type asyncWriter struct {
+	send   func([]byte) error
+	frames sync.Pool
+	queue  chan *[]byte
+	result chan error
+	// exited is closed once the sender returned and ran exit
+	exited chan struct{}
+
+	// guarded by mux
+	mux     sync.Mutex
+	timer   *time.Timer
+	stalled bool
+	closed  bool
+}
+
+// newAsyncWriter starts the sender of frames up to size bytes, exit runs after its last send
+func newAsyncWriter(send func([]byte) error, size int, exit func()) *asyncWriter {
+	w := &asyncWriter{
+		send:   send,
+		queue:  make(chan *[]byte),
+		result: make(chan error, 1),
+		exited: make(chan struct{}),
+	}
+	w.frames.New = func() any {
+		buf := make([]byte, 0, size)
+		return &buf
+	}
+
+	go func() {
+		defer close(w.exited)
+		defer exit()
+		for buf := range w.queue {
+			err := w.send(*buf)
+			w.frames.Put(buf)
+			w.result <- err
+		}
+	}()
+	return w
+}
+
+// Write hands a copy of p to the sender and waits for the send
+func (w *asyncWriter) Write(p []byte) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.closed {
+		return errWriterClosed
+	}
+	if w.stalled {
+		select {
+		case <-w.result:
+			w.stalled = false
+		default:
+			return errWriteStalled
+		}
+	}
+
+	buf := w.frames.Get().(*[]byte)
+	*buf = append((*buf)[:0], p...)
+	w.queue <- buf
+
+	if w.timer == nil {
+		w.timer = time.NewTimer(writeTimeout)
+	} else {
+		w.timer.Reset(writeTimeout)
+	}
+	select {
+	case err := <-w.result:
+		w.timer.Stop()
+		return err
+	case <-w.timer.C:
+		w.stalled = true
+		return errWriteTimeout
+	}
+}
+
+// Close stops the sender and waits writeTimeout at most for a blocked send,
+// exit runs whenever that send returns
+func (w *asyncWriter) Close() {
+	w.mux.Lock()
+	if w.closed {
+		w.mux.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.queue)
+	w.mux.Unlock()
+
+	select {
+	case <-w.exited:
+	case <-time.After(writeTimeout):
+		slog.Warn("Write still blocked, closing later")
+	}
+}
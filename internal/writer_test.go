@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAsyncWriterStall(t *testing.T) {
+	unblock := make(chan struct{})
+	var sent [][]byte
+	send := func(p []byte) error {
+		<-unblock
+		sent = append(sent, append([]byte(nil), p...))
+		return nil
+	}
+	w := newAsyncWriter(send, 64, func() {})
+	defer w.Close()
+
+	if err := w.Write([]byte("first")); !errors.Is(err, errWriteTimeout) {
+		t.Fatalf("blocked write returned %v", err)
+	}
+	if err := w.Write([]byte("dropped")); !errors.Is(err, errWriteStalled) {
+		t.Fatalf("write behind a blocked one returned %v", err)
+	}
+
+	close(unblock)
+	err := w.Write([]byte("second"))
+	for errors.Is(err, errWriteStalled) {
+		time.Sleep(time.Millisecond)
+		err = w.Write([]byte("second"))
+	}
+	if err != nil {
+		t.Fatalf("write after the link drained: %v", err)
+	}
+	if len(sent) != 2 || string(sent[0]) != "first" || string(sent[1]) != "second" {
+		t.Fatalf("sent %q", sent)
+	}
+}
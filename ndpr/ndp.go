@@ -0,0 +1,221 @@
+package ndpr
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+const (
+	FlagRouter    = 0x80
+	FlagSolicited = 0x40
+	FlagOverride  = 0x20
+)
+
+var (
+	AllNodes    = net.ParseIP("ff02::1")
+	AllNodesMAC = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+)
+
+// LinkLocal returns the EUI-64 link-local address for the given MAC.
+func LinkLocal(mac net.HardwareAddr) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	ip[0], ip[1] = 0xfe, 0x80
+	ip[8] = mac[0] ^ 0x02
+	ip[9], ip[10] = mac[1], mac[2]
+	ip[11], ip[12] = 0xff, 0xfe
+	ip[13], ip[14], ip[15] = mac[3], mac[4], mac[5]
+	return ip
+}
+
+// MulticastMAC maps an IPv6 multicast address to its Ethernet group address.
+func MulticastMAC(ip net.IP) net.HardwareAddr {
+	ip = ip.To16()
+	return net.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+}
+
+// SolicitedNode returns the solicited-node multicast address of ip.
+func SolicitedNode(ip net.IP) net.IP {
+	ip = ip.To16()
+	return net.IP{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xff, ip[13], ip[14], ip[15]}
+}
+
+// SendNeighborSolicit builds a Neighbor Solicitation for target to its solicited-node group.
+func SendNeighborSolicit(target net.IP, localIP net.IP, localMAC net.HardwareAddr) ([]byte, error) {
+	dstIP := SolicitedNode(target)
+
+	ethernet := &layers.Ethernet{
+		SrcMAC:       localMAC,
+		DstMAC:       MulticastMAC(dstIP),
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip6 := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255,
+		SrcIP:      localIP,
+		DstIP:      dstIP,
+	}
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0),
+	}
+	if err := icmp.SetNetworkLayerForChecksum(ip6); err != nil {
+		return nil, err
+	}
+	sol := &layers.ICMPv6NeighborSolicitation{
+		TargetAddress: target,
+		Options: layers.ICMPv6Options{
+			{Type: layers.ICMPv6OptSourceAddress, Data: localMAC},
+		},
+	}
+
+	sbuf := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+
+	if err := gopacket.SerializeLayers(sbuf, options, ethernet, ip6, icmp, sol); err != nil {
+		return nil, err
+	}
+
+	return sbuf.Bytes(), nil
+}
+
+// SendNeighborAdvert builds a Neighbor Advertisement for target sent from localMAC.
+// An unsolicited advertisement is sent to all nodes when dstIP is nil.
+func SendNeighborAdvert(target net.IP, localMAC net.HardwareAddr, dstIP net.IP, dstMAC net.HardwareAddr, flags uint8) ([]byte, error) {
+	if dstIP == nil {
+		dstIP, dstMAC = AllNodes, AllNodesMAC
+	}
+
+	ethernet := &layers.Ethernet{
+		SrcMAC:       localMAC,
+		DstMAC:       dstMAC,
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip6 := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255,
+		SrcIP:      target,
+		DstIP:      dstIP,
+	}
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0),
+	}
+	if err := icmp.SetNetworkLayerForChecksum(ip6); err != nil {
+		return nil, err
+	}
+	adv := &layers.ICMPv6NeighborAdvertisement{
+		Flags:         flags,
+		TargetAddress: target,
+		Options: layers.ICMPv6Options{
+			{Type: layers.ICMPv6OptTargetAddress, Data: localMAC},
+		},
+	}
+
+	sbuf := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+
+	if err := gopacket.SerializeLayers(sbuf, options, ethernet, ip6, icmp, adv); err != nil {
+		return nil, err
+	}
+
+	return sbuf.Bytes(), nil
+}
+
+const (
+	optRDNSS = layers.ICMPv6Opt(25)
+
+	prefixFlagOnLink     = 0x80
+	prefixFlagAutonomous = 0x40
+)
+
+// RouterAdvert describes what the gateway announces to the link.
+type RouterAdvert struct {
+	Prefix   *net.IPNet
+	RDNSS    []net.IP
+	Lifetime time.Duration
+	MTU      int
+}
+
+// SendRouterAdvert builds a Router Advertisement to all nodes from the link-local address of localMAC.
+// A zero Lifetime withdraws the router, its prefix and DNS servers.
+func SendRouterAdvert(ra RouterAdvert, localMAC net.HardwareAddr) ([]byte, error) {
+	lifetime := uint32(ra.Lifetime / time.Second)
+
+	ethernet := &layers.Ethernet{
+		SrcMAC:       localMAC,
+		DstMAC:       AllNodesMAC,
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip6 := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255,
+		SrcIP:      LinkLocal(localMAC),
+		DstIP:      AllNodes,
+	}
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeRouterAdvertisement, 0),
+	}
+	if err := icmp.SetNetworkLayerForChecksum(ip6); err != nil {
+		return nil, err
+	}
+
+	opts := layers.ICMPv6Options{
+		{Type: layers.ICMPv6OptSourceAddress, Data: localMAC},
+	}
+
+	if ra.Prefix != nil {
+		ones, _ := ra.Prefix.Mask.Size()
+		data := make([]byte, 30)
+		data[0] = byte(ones)
+		data[1] = prefixFlagOnLink | prefixFlagAutonomous
+		// Valid lifetime is kept so addresses survive a withdrawal, only the preferred one drops to zero
+		binary.BigEndian.PutUint32(data[2:], max(lifetime, uint32(2*time.Hour/time.Second)))
+		binary.BigEndian.PutUint32(data[6:], lifetime)
+		copy(data[14:], ra.Prefix.IP.To16())
+		opts = append(opts, layers.ICMPv6Option{Type: layers.ICMPv6OptPrefixInfo, Data: data})
+	}
+
+	if len(ra.RDNSS) > 0 {
+		data := make([]byte, 6, 6+len(ra.RDNSS)*net.IPv6len)
+		binary.BigEndian.PutUint32(data[2:], lifetime)
+		for _, ip := range ra.RDNSS {
+			data = append(data, ip.To16()...)
+		}
+		opts = append(opts, layers.ICMPv6Option{Type: optRDNSS, Data: data})
+	}
+
+	if ra.MTU > 0 {
+		data := make([]byte, 6)
+		binary.BigEndian.PutUint32(data[2:], uint32(ra.MTU))
+		opts = append(opts, layers.ICMPv6Option{Type: layers.ICMPv6OptMTU, Data: data})
+	}
+
+	adv := &layers.ICMPv6RouterAdvertisement{
+		HopLimit:       64,
+		RouterLifetime: uint16(min(lifetime, 9000)),
+		Options:        opts,
+	}
+
+	sbuf := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+
+	if err := gopacket.SerializeLayers(sbuf, options, ethernet, ip6, icmp, adv); err != nil {
+		return nil, err
+	}
+
+	return sbuf.Bytes(), nil
+}